@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Anchors and aliases
+ */
+package ucl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// How aliases resolve, set by SetAliasMode
+const (
+	AliasCopy  = iota // each alias yields a deep copy of the value (default)
+	AliasShare        // aliases share the maps and arrays of the value
+)
+
+// anchor is a value named by "&name"
+type anchor struct {
+	val  interface{}
+	line int
+	done bool // false while the value is being parsed
+}
+
+// anchorname returns the name following the marker c at the start of val,
+// as in "&name" or "*name", if val holds nothing else
+func anchorname(val []byte, c byte) (string, bool) {
+	if len(val) < 2 || val[0] != c {
+		return "", false
+	}
+	for _, b := range val[1:] {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' ||
+			b >= '0' && b <= '9' || b == '_' || b == '-') {
+			return "", false
+		}
+	}
+	return string(val[1:]), true
+}
+
+// parseanchor parses the value following the "&name" tag t and records it
+// under name
+func (d *Decoder) parseanchor(t *tag, name string,
+	parent interface{}) (interface{}, error) {
+
+	d.anchors[name] = &anchor{line: t.line}
+	nt, err := d.nexttag()
+	if err != nil {
+		return nil, err
+	}
+	switch nt.state {
+	case SEMICOL, COMMA, BRACECLOSE, BRACKETCLOSE, EQUAL, COLON:
+		return nil, fmt.Errorf("anchor &%s at line %d has no value",
+			name, t.line)
+	}
+
+	res, err := d.parsevalue(nt, parent)
+	if err != nil {
+		return res, err
+	}
+	if restag, ok := res.(*tag); ok {
+		// a scalar ending the enclosing object or array; the caller
+		// takes it from the tag, so have it resolve the anchor instead
+		v, err := d.leaf(restag.val, TokenKind(restag.flag), nt.line)
+		if err != nil {
+			return nil, err
+		}
+		d.anchors[name] = &anchor{v, t.line, true}
+		restag.val, restag.flag = []byte("*"+name), int32(TAG)
+		return restag, nil
+	}
+	d.anchors[name] = &anchor{res, t.line, true}
+	return res, nil
+}
+
+// leaf converts the value of a leaf tag, resolving anchors and aliases in
+// unquoted values when enabled
+func (d *Decoder) leaf(val []byte, state TokenKind, line int) (interface{},
+	error) {
+
+	if d.anchors == nil || state != TAG {
+		return d.scalar(val, state), nil
+	}
+	if name, ok := anchorname(val, '*'); ok {
+		a := d.anchors[name]
+		if a == nil {
+			return nil, fmt.Errorf("undefined alias *%s at line %d",
+				name, line)
+		}
+		if !a.done {
+			return nil, fmt.Errorf("alias *%s at line %d refers to the "+
+				"value of anchor &%s at line %d enclosing it", name, line,
+				name, a.line)
+		}
+		if d.aliasmode == AliasShare {
+			return a.val, nil
+		}
+		return copyvalue(a.val), nil
+	}
+	if sp := bytes.IndexByte(val, ' '); sp > 0 {
+		// "&name value" scans as a single tag
+		if name, ok := anchorname(val[:sp], '&'); ok {
+			d.anchors[name] = &anchor{line: line}
+			v, err := d.leaf(bytes.TrimLeft(val[sp:], " \t"), state, line)
+			if err != nil {
+				return nil, err
+			}
+			d.anchors[name] = &anchor{v, line, true}
+			return v, nil
+		}
+	}
+	return d.scalar(val, state), nil
+}
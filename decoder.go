@@ -0,0 +1,1294 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// The order of the keys as they appear in the file; this allows the user to
+// have their own order for items.
+const KeyOrder = "--ucl-keyorder--"
+
+// Allow to disable constructing the KeyOrder arrays
+var UclExportKeyOrder bool = true
+
+var Ucldebug bool = true
+
+func debug(a ...interface{}) {
+	if Ucldebug {
+		fmt.Println(a...)
+	}
+}
+
+// A Decoder reads and parses UCL from an input stream.
+type Decoder struct {
+	scanner *scanner
+	closers []io.Closer // closed by Close, innermost first
+
+	ucl map[string]interface{}
+
+	tags   []*tag
+	tagsi  int
+	unread []*tag // tags pushed back by lookahead, last one is next
+
+	dupmode int
+	lines   map[uintptr]map[string]int // first line of keys, by map
+
+	schema   map[string]interface{}
+	required []string // paths Decode checks are present
+
+	typed   bool                // infer types of unquoted values
+	numbers bool                // keep unquoted numbers as Number
+	keyfunc func(string) string // applied to keys before insertion
+	spaces  bool                // split unquoted values at spaces
+	intern  map[string]string   // keys seen, when interning them
+
+	inisections bool                   // [name] headers begin sections
+	cursection  map[string]interface{} // object of the last [name] header
+
+	anchors   map[string]*anchor // values named by "&name", when enabled
+	aliasmode int
+
+	ordered      bool // return objects within the result as OrderedMaps
+	unmarshaling bool // record key lines for Unmarshal errors
+	foldfields   bool // match keys to struct fields ignoring case
+	nounknown    bool // keys without a struct field are errors
+	strict       bool // input after a braced top-level object is an error
+	baretrue     bool // keys without a value are true rather than null
+	timelayouts  []string
+	decoders     map[reflect.Type]func(string) (interface{}, error)
+	enums        map[reflect.Type]map[string]int64
+
+	offsets map[string][2]int // spans of the values of top-level keys
+	span    [2]int            // span of the tags read for a value
+
+	keys     int // keys parsed, for Stats
+	comments int // comments skipped, for Stats
+
+	errmode int     // ErrorStop or CollectAll
+	errs    []error // errors collected in CollectAll mode
+	depth   int     // braces and brackets open, as of the tags read
+
+	done bool
+	err  error
+}
+
+// Handling of keys repeated within an object
+//
+// In DuplicateArray mode a value is appended to the existing one if that is
+// an array, so "k [a, b]; k c;" yields [a, b, c] while "k c; k [a, b];"
+// yields [c, [a, b]]. DuplicateFlatten always splices arrays in, giving a
+// flat array in document order whichever way the values are mixed.
+const (
+	DuplicateArray     = iota // collect the values into an array (default)
+	DuplicateOverwrite        // the last value replaces earlier ones
+	DuplicateError            // fail with a *DuplicateKeyError
+	DuplicateFlatten          // collect values into a flat array
+)
+
+// Handling of errors by Decode
+//
+// In CollectAll mode the statement in which an error occurs is skipped, up
+// to the next ';', ',', newline or the '}' closing its object, and parsing
+// carries on, so that all errors of a document can be reported at once.
+// Decode then fails with DecodeErrors holding them in document order.
+// Running out of input, as within an unclosed object, still ends decoding.
+const (
+	ErrorStop  = iota // stop at the first error (default)
+	CollectAll        // skip statements with errors and report them all
+)
+
+// DecodeErrors is returned by Decode in CollectAll mode when the document
+// has errors.
+type DecodeErrors []error
+
+func (errs DecodeErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// DuplicateKeyError reports a repeated key in DuplicateError mode.
+type DuplicateKeyError struct {
+	Key       string
+	Line      int // line of the repeated key
+	FirstLine int // line on which the key was first defined
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key \"%s\" at line %d, first defined at line %d",
+		e.Key, e.Line, e.FirstLine)
+}
+
+// NewDecoder returns a decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{
+		scanner: newScanner(r),
+		ucl:     make(map[string]interface{}),
+	}
+	if c, ok := r.(io.Closer); ok {
+		d.closers = []io.Closer{c}
+	}
+
+	return d
+}
+
+// Close closes the input if it is an io.Closer, e.g. an *os.File, along
+// with any decompressor set up by NewDecoderReader.
+func (d *Decoder) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	d.closers = nil
+	d.scanner.release()
+	return err
+}
+
+// SetDuplicateKeyMode sets how keys repeated within an object are handled:
+// DuplicateArray (default), DuplicateOverwrite, DuplicateError or
+// DuplicateFlatten.
+func (d *Decoder) SetDuplicateKeyMode(mode int) {
+	d.dupmode = mode
+}
+
+// SetErrorMode sets how Decode handles errors in the document: ErrorStop
+// (default) or CollectAll.
+func (d *Decoder) SetErrorMode(mode int) {
+	d.errmode = mode
+}
+
+// SetBarewordTerminators sets the characters that end an unquoted value in
+// addition to ';' and newline; the default is DefaultBarewordTerminators.
+// Within arrays a terminator separates elements, elsewhere it ends the
+// statement. A ',' keeps its special rule of only terminating within arrays
+// and objects. Terminators have no effect within quoted strings, so values
+// containing them can still be written by quoting.
+func (d *Decoder) SetBarewordTerminators(set string) {
+	d.scanner.terminators = set
+}
+
+// SetTypedValues makes unquoted scalars decode to typed values instead of
+// strings, ready for use with encoding/json and the like:
+//
+//	null, nil                        nil
+//	true, yes, on / false, no, off   bool
+//	42, -7, 0x1f                     int64
+//	1.5, 1e3                         float64
+//	10k, 2m, 1g / 10kb, 2mb, 1gb     int64, times 1000^n / 1024^n
+//	30s, 100ms, 5min, 2h, 1d, 1w, 1y float64 seconds
+//	/^a+b$/                          Regex
+//
+// The same applies to array elements. Quoted strings and heredocs are
+// always strings.
+func (d *Decoder) SetTypedValues(on bool) {
+	d.typed = on
+}
+
+// SetBareKeyAsTrue makes a key without a value, as in "ssl;" or "{ ssl }",
+// decode to true rather than nil, for nginx-style flags. Only a missing
+// value is affected: "ssl false;" is still the string "false", or false
+// with SetTypedValues, and with SetTypedValues an explicit "ssl null;"
+// still decodes to nil.
+func (d *Decoder) SetBareKeyAsTrue(on bool) {
+	d.baretrue = on
+}
+
+// bare is the value of a key written without one
+func (d *Decoder) bare() interface{} {
+	if d.baretrue {
+		return true
+	}
+	return nil
+}
+
+// SetUseNumber makes unquoted numbers, including those with size
+// multipliers, decode to a Number holding their text, like the UseNumber
+// method of encoding/json. This keeps integers too large for int64 or
+// float64 intact. It takes precedence over SetTypedValues for numbers.
+func (d *Decoder) SetUseNumber(on bool) {
+	d.numbers = on
+}
+
+// SetCaseInsensitiveFields makes Unmarshal match keys that have no field of
+// the same name to a field whose name differs only in case, as
+// encoding/json does, so "Port" sets a field tagged "port". A key matching
+// several such fields is an error.
+func (d *Decoder) SetCaseInsensitiveFields(on bool) {
+	d.foldfields = on
+}
+
+// DisallowUnknownFields makes Unmarshal fail on a key that matches no field
+// of the struct it is stored in, unless the struct has a "remain" field to
+// collect such keys.
+func (d *Decoder) DisallowUnknownFields() {
+	d.nounknown = true
+}
+
+// SetAnchors enables references to values written earlier in the input.
+// An unquoted "&name" before a value, as in "base &defaults { port 80; }",
+// names it, and a later unquoted "*name" in place of a value stands for it:
+// "dev *defaults". An alias to an anchor that is not defined yet, or to the
+// value it is part of, is an error. Anchors may be redefined; aliases refer
+// to the last definition before them.
+func (d *Decoder) SetAnchors(on bool) {
+	d.anchors = nil
+	if on {
+		d.anchors = make(map[string]*anchor)
+	}
+}
+
+// SetAliasMode sets whether the values of aliases enabled by SetAnchors are
+// deep copies of the anchored value, AliasCopy (default), so changing one
+// leaves the others alone, or share its objects and arrays, AliasShare.
+func (d *Decoder) SetAliasMode(mode int) {
+	d.aliasmode = mode
+}
+
+// SetTimeLayouts sets the layouts, as for time.Parse, tried in turn when
+// Unmarshal stores a value in a time.Time. UnixTime accepts integer seconds
+// since the epoch. The default is time.RFC3339Nano, which also takes times
+// without fractional seconds, as Encoder writes them by default.
+func (d *Decoder) SetTimeLayouts(layouts []string) {
+	d.timelayouts = layouts
+}
+
+// SetUseOrderedMap makes Decode return the objects within the top-level map
+// as *OrderedMap rather than maps with a KeyOrder entry. The top-level map
+// stays a map; DecodeOrdered converts it too. Unmarshal is not affected.
+func (d *Decoder) SetUseOrderedMap(on bool) {
+	d.ordered = on
+}
+
+// RegisterDecoder sets the function Unmarshal uses to parse scalars stored
+// in values of type t, such as net.IP, before trying the conversions based
+// on the kind of t. The function gets the scalar as written and returns a
+// value assignable to t.
+func (d *Decoder) RegisterDecoder(t reflect.Type,
+	f func(raw string) (interface{}, error)) {
+
+	if d.decoders == nil {
+		d.decoders = make(map[reflect.Type]func(string) (interface{}, error))
+	}
+	d.decoders[t] = f
+}
+
+// RegisterEnum makes Unmarshal store the names in names as the values they
+// stand for in the integer type t, the reverse of Encoder.RegisterEnum, so
+// the same table reads back what the Encoder writes. Numbers are still
+// stored as such.
+func (d *Decoder) RegisterEnum(t reflect.Type, names map[int64]string) {
+	if d.enums == nil {
+		d.enums = make(map[reflect.Type]map[string]int64)
+	}
+	values := make(map[string]int64, len(names))
+	for n, name := range names {
+		values[name] = n
+	}
+	d.enums[t] = values
+}
+
+// SetINISections makes a "[name]" header on a line of its own begin an
+// object holding the keys that follow, up to the next header, as in INI
+// files. Headers only appear at the top level; a bracket anywhere else, or
+// holding more than a single name as in "[1, 2]", still begins an array.
+func (d *Decoder) SetINISections(on bool) {
+	d.inisections = on
+}
+
+// SetSpaceSeparatedArrays makes unquoted values holding several words
+// decode to arrays, as in nginx-style directives: "listen 80 443 ssl;"
+// yields [80, 443, ssl] while "listen 80;" stays a scalar. Quoted strings
+// are not split.
+func (d *Decoder) SetSpaceSeparatedArrays(on bool) {
+	d.spaces = on
+}
+
+// SetLineContinuation makes a backslash at the end of a line continue an
+// unquoted value on the next line, joined by a single space in place of the
+// backslash, newline and indentation. Within quoted strings a backslash
+// before a newline drops both, joining the lines directly.
+func (d *Decoder) SetLineContinuation(on bool) {
+	d.scanner.continuation = on
+}
+
+// SetNewlineTerminates controls whether a newline ends a statement like
+// ';' does, which is the default. With it disabled statements must end
+// with ';' or a closing brace, and unquoted values may span lines, keeping
+// the newlines within them.
+func (d *Decoder) SetNewlineTerminates(on bool) {
+	d.scanner.nlcontinues = !on
+}
+
+// SetJSONCompat makes ',' separate members at the top level too, as it
+// does within braces, so "a 1, b 2" holds two keys rather than the value
+// "1, b 2".
+func (d *Decoder) SetJSONCompat(on bool) {
+	d.scanner.jsoncompat = on
+}
+
+// SetCommentChars sets the characters that begin comments running to the
+// end of the line, "#" by default, and whether /* */ block comments are
+// recognized. An empty single disables line comments. When ';' begins
+// comments it no longer ends statements, so each ends at its newline.
+func (d *Decoder) SetCommentChars(single string, allowBlock bool) {
+	d.scanner.hcomments = single
+	d.scanner.noblock = !allowBlock
+}
+
+// SetHeredocTrim sets how the lines of <<EOD multi-line strings are
+// trimmed: HeredocTrimNone (default) keeps them as written,
+// HeredocTrimLeadingWhitespace strips the indentation of each line and
+// HeredocTrimCommonIndent strips the indentation all lines share, like
+// Python's textwrap.dedent, keeping relative indentation.
+func (d *Decoder) SetHeredocTrim(mode int) {
+	d.scanner.heredoctrim = mode
+}
+
+// SetKeyTransform sets a function applied to every key before it is added
+// to its object, e.g. strings.ToLower for case-insensitive configs. Keys are
+// compared, recorded in KeyOrder and reported after transformation, so keys
+// that transform to the same string are handled per the duplicate key mode.
+func (d *Decoder) SetKeyTransform(f func(string) string) {
+	d.keyfunc = f
+}
+
+// SetInternStrings makes the decoder share one string among all keys with
+// the same text, so that a document repeating the same keys many times,
+// such as a long array of objects, holds a single copy of each. Keys are
+// compared by value as ever, so this only saves memory. The strings are
+// kept until the decoder is garbage.
+func (d *Decoder) SetInternStrings(on bool) {
+	d.intern = nil
+	if on {
+		d.intern = make(map[string]string)
+	}
+}
+
+// internkey returns the key written as v, interned if enabled
+func (d *Decoder) internkey(v []byte) string {
+	if d.intern == nil {
+		return string(v)
+	}
+	if k, ok := d.intern[string(v)]; ok {
+		return k
+	}
+	k := string(v)
+	d.intern[k] = k
+	return k
+}
+
+// SetProgressCallback sets a function called with the total number of
+// bytes read so far each time the decoder reads more input, e.g. to drive a
+// progress bar. It runs on the decoding goroutine and should return quickly.
+// A nil f disables the callback.
+func (d *Decoder) SetProgressCallback(f func(bytesRead int64)) {
+	d.scanner.progress = f
+}
+
+// SetTrackOffsets makes the decoder record where the value of each
+// top-level key lies in the input, for Offsets.
+func (d *Decoder) SetTrackOffsets(on bool) {
+	d.offsets, d.scanner.offsets = nil, nil
+	if on {
+		d.offsets = make(map[string][2]int)
+		d.scanner.offsets = make(map[*tag][2]int)
+	}
+}
+
+// Offsets returns the start and end byte offsets in the input of the value
+// of each top-level key decoded so far, as set up by SetTrackOffsets. The
+// span of an object or array includes its braces or brackets, that of a
+// quoted string its quotes. For a repeated key it is that of the last
+// value; keys without a value are left out.
+func (d *Decoder) Offsets() map[string][2]int {
+	return d.offsets
+}
+
+// extendspan widens the span being recorded to cover tag t
+func (d *Decoder) extendspan(t *tag) {
+	switch t.state {
+	case SEMICOL, COMMA, EQUAL, COLON:
+		return
+	}
+	sp, ok := d.scanner.offsets[t]
+	if !ok {
+		return
+	}
+	if d.span[0] < 0 || sp[0] < d.span[0] {
+		d.span[0] = sp[0]
+	}
+	if sp[1] > d.span[1] {
+		d.span[1] = sp[1]
+	}
+}
+
+// DecodeStats holds counters gathered while decoding.
+type DecodeStats struct {
+	KeysParsed      int   // keys parsed, including repeated ones
+	MaxDepth        int   // deepest nesting of braces and brackets
+	BytesRead       int64 // bytes read from the input
+	CommentsSkipped int
+}
+
+// Stats returns the counters for the input decoded so far.
+func (d *Decoder) Stats() DecodeStats {
+	return DecodeStats{
+		KeysParsed:      d.keys,
+		MaxDepth:        d.scanner.maxdepth,
+		BytesRead:       d.scanner.bytesread,
+		CommentsSkipped: d.comments,
+	}
+}
+
+// NewDecoderReader returns a decoder that reads from r, transparently
+// decompressing it if it starts with a gzip header.
+func NewDecoderReader(r io.Reader) (*Decoder, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		d := NewDecoder(zr)
+		if c, ok := r.(io.Closer); ok {
+			d.closers = append(d.closers, c)
+		}
+		return d, nil
+	}
+	d := NewDecoder(br)
+	if c, ok := r.(io.Closer); ok {
+		d.closers = []io.Closer{c}
+	}
+	return d, nil
+}
+
+// Parser is the former name of Decoder.
+//
+// Deprecated: use Decoder.
+type Parser = Decoder
+
+// NewParser returns a decoder that reads from r.
+//
+// Deprecated: use NewDecoder.
+func NewParser(r io.Reader) *Parser {
+	return NewDecoder(r)
+}
+
+func (d *Decoder) nexttag() (*tag, error) {
+	var err error
+
+	if d.done {
+		return nil, io.EOF
+	}
+
+	if n := len(d.unread); n > 0 {
+		t := d.unread[n-1]
+		d.unread = d.unread[:n-1]
+		if d.offsets != nil {
+			d.extendspan(t)
+		}
+		d.nest(t, 1)
+		return t, nil
+	}
+
+	for {
+		if d.tagsi >= len(d.tags) {
+			d.tags, err = d.scanner.nexttags()
+			if err != nil {
+				if d.errmode == CollectAll {
+					d.scanner.resync()
+				}
+				return nil, err
+			}
+			d.tagsi = 0
+		}
+		for ; d.tagsi < len(d.tags); d.tagsi++ {
+			m := d.tags[d.tagsi]
+			if m.state == WHITESPACE {
+				continue
+			}
+			if m.state == LCOMMENT || m.state == HCOMMENT {
+				d.comments++
+				continue
+			}
+			d.tagsi++
+			if d.offsets != nil {
+				d.extendspan(m)
+			}
+			d.nest(m, 1)
+			return m, nil
+		}
+	}
+}
+
+// nest counts the braces and brackets open as tag t is read, for n 1, or
+// pushed back, for n -1
+func (d *Decoder) nest(t *tag, n int) {
+	switch t.state {
+	case BRACEOPEN, BRACKETOPEN:
+		d.depth += n
+	case BRACECLOSE, BRACKETCLOSE:
+		d.depth -= n
+	}
+}
+
+// collect records err in CollectAll mode, returning nil as parsing goes on,
+// and otherwise returns err
+func (d *Decoder) collect(err error) error {
+	if err == nil || d.errmode != CollectAll || err == io.EOF ||
+		err == UnexpectedEOF {
+		return err
+	}
+	d.errs = append(d.errs, err)
+	return nil
+}
+
+// resume collects err and skips the rest of the statement in which it
+// occurred at the given depth, leaving a '}' closing the enclosing object to
+// be read next. It returns any error that ends parsing instead.
+func (d *Decoder) resume(err error, depth int) error {
+	if err = d.collect(err); err != nil {
+		return err
+	}
+	for {
+		t, err := d.nexttag()
+		if err != nil {
+			if err = d.collect(err); err != nil {
+				return err
+			}
+			continue
+		}
+		switch t.state {
+		case SEMICOL, COMMA:
+			if d.depth <= depth {
+				return nil
+			}
+		case BRACECLOSE, BRACKETCLOSE:
+			if d.depth < depth {
+				d.pushback(t)
+				return nil
+			}
+		}
+	}
+}
+
+// scalar converts the value of a leaf tag of the given kind
+func (d *Decoder) scalar(val []byte, state TokenKind) interface{} {
+	if d.spaces && state == TAG {
+		if fields := strings.Fields(string(val)); len(fields) > 1 {
+			list := make([]interface{}, len(fields))
+			for i := range fields {
+				list[i] = d.scalar([]byte(fields[i]), state)
+			}
+			return list
+		}
+	}
+	if d.numbers && state == TAG {
+		if _, ok := parsenumber(string(val)); ok {
+			return Number(val)
+		}
+	}
+	if d.unmarshaling && state == TAG &&
+		(string(val) == "null" || string(val) == "nil") {
+		// stored as a nil pointer; a quoted "null" stays a string
+		return nil
+	}
+	if d.typed && (state == TAG || state == SLASH) {
+		if r, ok := toregex(string(val)); ok {
+			return r
+		}
+	}
+	if d.typed && state == TAG {
+		return typedvalue(string(val))
+	}
+	return string(val)
+}
+
+// pushback returns tags to be read again by nexttag, in the given order
+func (d *Decoder) pushback(tags ...*tag) {
+	for i := len(tags) - 1; i >= 0; i-- {
+		d.unread = append(d.unread, tags[i])
+		d.nest(tags[i], -1)
+	}
+}
+
+func (d *Decoder) parsevalue(t *tag, parent interface{}) (interface{}, error) {
+	var err error
+
+restart:
+	if t == nil {
+		t, err = d.nexttag()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch t.state {
+	case TAG, QUOTE, VQUOTE, SLASH:
+		if d.anchors != nil && t.state == TAG {
+			if name, ok := anchorname(t.val, '&'); ok {
+				return d.parseanchor(t, name, parent)
+			}
+		}
+
+		// this could be either a value or a new key
+		// have to see if the followon tags exist
+		nt, err := d.nexttag()
+		if err != nil {
+			return nil, err
+		}
+
+		if nt == nil || nt.state == SEMICOL || nt.state == COMMA {
+			v, err := d.leaf(t.val, t.state, t.line) // leaf value; done
+			if err != nil && nt != nil {
+				// leave the end of the statement to recover at
+				d.pushback(nt)
+			}
+			return v, err
+		}
+		if nt.state == BRACECLOSE || nt.state == BRACKETCLOSE {
+			nt.val = t.val
+			nt.flag = int32(t.state)
+			return nt, nil
+		}
+
+		// "t" is a new key tag
+		themap := make(map[string]interface{})
+		res, err := d.parsevalue(nt, parent)
+
+		if err != nil {
+			debug("Error:", err)
+			return nil, err
+		}
+		if restag, ok := res.(*tag); ok &&
+			(restag.state == BRACECLOSE || restag.state == BRACKETCLOSE) {
+			// a scalar ending the enclosing object or array, as in
+			// "[a=1]"; the caller still has to see the close
+			res, err = d.leaf(restag.val, TokenKind(restag.flag), restag.line)
+			if err != nil {
+				return nil, err
+			}
+			restag.val = []byte{'}'}
+			if restag.state == BRACKETCLOSE {
+				restag.val = []byte{']'}
+			}
+			d.pushback(restag)
+		}
+
+		if err = d.addkey(themap, d.internkey(t.val), res,
+			t.line); err != nil {
+			return nil, err
+		}
+		return themap, nil
+
+	case SEMICOL:
+		// no value, let parent handle it
+		if parent == nil {
+			return t, fmt.Errorf("unexpected ';' at line %d", d.scanner.line)
+		}
+		return parent, nil
+
+	case COMMA:
+		// no value, let parent handle it
+		if parent == nil {
+			return t, fmt.Errorf("unexpected ',' at line %d", d.scanner.line)
+		}
+		return parent, nil
+
+	case MLSTRING:
+		// this must only be a value
+		return string(t.val), nil
+
+	case BRACEOPEN:
+		// {, new map
+		res, err := d.parse(t, parent)
+		if err != nil {
+			debug("parse error:", err)
+		}
+		return res, err
+
+	case BRACECLOSE:
+		// return until we hit the stack that has BRACEOPEN
+		return parent, nil
+
+	case BRACKETOPEN:
+		thelist := make([]interface{}, 0, 32)
+		res, err := d.parselist(nil, thelist)
+		return res, err
+
+	case BRACKETCLOSE:
+		// list finished
+		return parent, nil
+
+	case EQUAL, COLON:
+		t = nil
+		goto restart
+	}
+
+	return nil, nil
+}
+
+// parselist parses the elements of an array up to its closing bracket. As
+// in objects, a key followed by a value, whether written "a 1", "a=1" or
+// "a: 1", is an object holding that key, so "[a=1, b=2]" holds two
+// single-key objects, the same as "[{a 1}, {b 2}]", while "[a, 1]" holds
+// two scalars.
+func (d *Decoder) parselist(t *tag, parent []interface{}) (ret interface{}, err error) {
+	// Parse until bracket close
+restart:
+	if t == nil {
+		t, err = d.nexttag()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch t.state {
+	case BRACKETCLOSE:
+		// list finished
+		return parent, nil
+
+	case SEMICOL, COLON, EQUAL:
+		// no value, let parent handle it
+		return nil, fmt.Errorf("Invalid tag %s line %d",
+			string(t.val), d.scanner.line)
+	case COMMA:
+		t = nil
+		goto restart
+
+	default:
+		// append child
+		res, err := d.parsevalue(t, nil)
+		if err != nil {
+			debug("error parsing value:", err)
+			return nil, err
+		} else {
+			if restag, ok := res.(*tag); ok {
+				// result is a tag; parsevalue didn't handle it
+				if restag.state == BRACKETCLOSE {
+					v, err := d.leaf(restag.val, TokenKind(restag.flag),
+						restag.line)
+					if err != nil {
+						return nil, err
+					}
+					parent = append(parent, v)
+					return parent, nil
+				} else {
+					return nil, fmt.Errorf("Unexpected tag %s, line %d\n",
+						string(restag.val), d.scanner.line)
+				}
+			}
+
+			parent = append(parent, res)
+		}
+		t = nil
+		goto restart
+	}
+}
+
+// addkey inserts a parsed key and value into themap, handling repeated keys
+// according to the duplicate key mode
+func (d *Decoder) addkey(themap map[string]interface{}, k string,
+	res interface{}, line int) error {
+
+	d.keys++
+	if d.keyfunc != nil {
+		k = d.keyfunc(k)
+	}
+
+	korder_intf, ok := themap[KeyOrder]
+	var korder []string
+	if !ok {
+		if UclExportKeyOrder {
+			// only initialize if requested
+			korder = make([]string, 0, 16)
+		}
+	} else {
+		korder, ok = korder_intf.([]string)
+		if !ok {
+			debug("key order is not slice")
+			return fmt.Errorf("map[--keyorder--] is not slice")
+		}
+	}
+
+	if mapitems, ok := themap[k]; ok {
+		switch d.dupmode {
+		case DuplicateError:
+			return &DuplicateKeyError{k, line, d.keylines(themap)[k]}
+		case DuplicateOverwrite:
+			themap[k] = res
+			return nil
+		case DuplicateFlatten:
+			themap[k] = flatappend(flatappend(nil, mapitems), res)
+			return nil
+		}
+
+		if childarray, ok := mapitems.([]interface{}); ok {
+			// already an array, so append
+			childarray = append(childarray, res)
+			themap[k] = childarray
+		} else {
+			childarray := make([]interface{}, 1, 2)
+			childarray[0] = themap[k]
+			childarray = append(childarray, res)
+			themap[k] = childarray
+		}
+	} else {
+		// doesn't exist
+		if cap(korder) != 0 {
+			// only update KeyOrder if it was initialized
+			korder = append(korder, k)
+			themap[KeyOrder] = korder
+		}
+		themap[k] = res
+		if d.dupmode == DuplicateError || d.schema != nil ||
+			d.unmarshaling {
+			d.keylines(themap)[k] = line
+		}
+	}
+	return nil
+}
+
+// flatappend appends v to list, splicing in its elements if it is an array
+func flatappend(list []interface{}, v interface{}) []interface{} {
+	if arr, ok := v.([]interface{}); ok {
+		return append(list, arr...)
+	}
+	return append(list, v)
+}
+
+// keylines returns the lines on which the keys of themap were first seen
+func (d *Decoder) keylines(themap map[string]interface{}) map[string]int {
+	if d.lines == nil {
+		d.lines = make(map[uintptr]map[string]int)
+	}
+	id := reflect.ValueOf(themap).Pointer()
+	lines, ok := d.lines[id]
+	if !ok {
+		lines = make(map[string]int)
+		d.lines[id] = lines
+	}
+	return lines
+}
+
+func (d *Decoder) parse(t *tag, parent interface{}) (ret interface{}, err error) {
+	defer func() {
+		d.err = err
+	}()
+
+restart:
+	if t == nil {
+		t, err = d.nexttag()
+		if err != nil {
+			if err = d.resume(err, d.depth); err != nil {
+				return nil, err
+			}
+			goto restart
+		}
+	}
+
+	switch t.state {
+	case TAG, QUOTE, VQUOTE, SLASH:
+		// new key
+		k := d.internkey(t.val)
+		line := t.line
+		depth := d.depth
+
+		themap, ok := parent.(map[string]interface{})
+		if !ok {
+			debug("not a map at tag:", k)
+			panic("...")
+		}
+
+		top := d.offsets != nil &&
+			reflect.ValueOf(themap).Pointer() == reflect.ValueOf(d.ucl).Pointer()
+		if top {
+			d.span = [2]int{-1, -1}
+		}
+		nt, err := d.nexttag()
+		if err != nil {
+			if err = d.resume(err, depth); err != nil {
+				return nil, err
+			}
+			t = nil
+			goto restart
+		}
+		var res interface{}
+		if nt.state == BRACECLOSE {
+			// a key without a value ending the object, as in "{ flag }"
+			res, t = d.bare(), nt
+		} else {
+			d.pushback(nt)
+			res, err = d.parsevalue(nil, nil)
+		}
+		if top && d.span[0] >= 0 {
+			sk := k
+			if d.keyfunc != nil {
+				sk = d.keyfunc(k)
+			}
+			d.offsets[sk] = d.span
+		}
+		if err != nil {
+			if restag, ok := res.(*tag); ok {
+				if restag.state == SEMICOL {
+					if restag.flag == eolsemi {
+						if err = d.collect(d.novalue(k, t)); err != nil {
+							return nil, err
+						}
+					}
+					// no value for key
+					res = d.bare()
+				}
+			} else {
+				debug("parsevalue error:", err)
+				if _, ok := res.(map[string]interface{}); ok {
+					// keep the partially parsed object
+					d.addkey(themap, k, res, line)
+				}
+				if err = d.resume(err, depth); err != nil {
+					return nil, err
+				}
+				t = nil
+				goto restart
+			}
+		} else if restag, ok := res.(*tag); ok {
+			// result is a tag; parsevalue didn't handle it
+			if restag.state != BRACECLOSE {
+				t = restag
+				goto restart
+			}
+			if res, err = d.leaf(restag.val, TokenKind(restag.flag),
+				restag.line); err != nil {
+				d.pushback(restag)
+				if err = d.resume(err, depth); err != nil {
+					return nil, err
+				}
+				t = nil
+				goto restart
+			}
+			t = restag
+		}
+
+		if err = d.collect(d.addkey(themap, k, res, line)); err != nil {
+			return nil, err
+		}
+		if t.state == BRACECLOSE {
+			// map completed
+			return parent, nil
+		}
+
+		// done for this tag; go to next
+		t = nil
+		goto restart
+
+	case SEMICOL, COMMA:
+		t = nil
+		goto restart
+
+	case MLSTRING:
+		// shouldn't happen
+		return nil, fmt.Errorf("Unexpected multi-line string")
+
+	case BRACEOPEN:
+		// {
+		// If parent is not a map and not nil, then error
+
+		var theparent interface{}
+		var ok bool
+		if parent == nil {
+			theparent = make(map[string]interface{})
+		} else if theparent, ok = parent.(map[string]interface{}); !ok {
+			if theparent, ok = parent.([]interface{}); !ok {
+				debug("Error braceopen - parent is not a map/list/nil")
+				return nil, fmt.Errorf("Invalid {, parent not nil|map|list")
+			}
+		}
+		res, err := d.parse(nil, theparent)
+		if err != nil {
+			debug("Error parsing brace", err)
+			// hand back what was parsed of the object
+			return theparent, err
+		}
+		return res, err
+
+	case BRACECLOSE:
+		// map finished
+		return parent, nil
+
+	case BRACKETOPEN:
+		if d.inisections {
+			sec, err := d.sectionheader(parent)
+			if err != nil {
+				return nil, err
+			}
+			if sec != nil {
+				parent = sec
+				t = nil
+				goto restart
+			}
+		}
+		thelist := make([]interface{}, 0, 32)
+		res, err := d.parselist(nil, thelist)
+		return res, err
+
+	case BRACKETCLOSE:
+		// list finished
+		return parent, nil
+	}
+
+	return nil, nil
+}
+
+// novalue checks the line after key k, tag t, which the newline left
+// without a value, for a value the key seems to rely on layout for: an
+// object or array opened on the next line or a line indented under the key
+func (d *Decoder) novalue(k string, t *tag) error {
+	nt, err := d.nexttag()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	d.pushback(nt)
+
+	switch {
+	case nt.state == BRACEOPEN || nt.state == BRACKETOPEN && !d.inisections:
+		return fmt.Errorf("key %q at line %d has no value before the end "+
+			"of the line; to give it the %q at line %d, put that on the "+
+			"same line as the key", k, t.line, nt.val, nt.line)
+	case t.col > 0 && nt.col > t.col &&
+		nt.state != BRACECLOSE && nt.state != BRACKETCLOSE:
+		return fmt.Errorf("key %q at line %d has no value before the end "+
+			"of the line, but line %d is indented under it; put the value "+
+			"on the same line as the key, or enclose the indented lines "+
+			"in { }", k, t.line, nt.line)
+	}
+	return nil
+}
+
+// sectionheader reads the rest of a "[name]" header following a '[' at
+// statement position in parent, returning the object of the section, or
+// nil after pushing back the tags read if they are not a header
+func (d *Decoder) sectionheader(parent interface{}) (map[string]interface{},
+	error) {
+
+	themap, ok := parent.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	id := reflect.ValueOf(themap).Pointer()
+	if id != reflect.ValueOf(d.ucl).Pointer() &&
+		(d.cursection == nil || id != reflect.ValueOf(d.cursection).Pointer()) {
+		// headers only appear at the top level
+		return nil, nil
+	}
+
+	name, err := d.nexttag()
+	if err != nil {
+		return nil, err
+	}
+	if name.state != TAG && name.state != QUOTE && name.state != VQUOTE {
+		d.pushback(name)
+		return nil, nil
+	}
+	end, err := d.nexttag()
+	if err != nil {
+		return nil, err
+	}
+	if end.state != BRACKETCLOSE {
+		d.pushback(name, end)
+		return nil, nil
+	}
+
+	k := d.internkey(name.val)
+	if d.keyfunc != nil {
+		k = d.keyfunc(k)
+	}
+	sec, ok := d.ucl[k].(map[string]interface{})
+	if !ok {
+		// a repeated header continues the section
+		sec = make(map[string]interface{})
+		if err = d.addkey(d.ucl, k, sec, name.line); err != nil {
+			return nil, err
+		}
+	}
+	d.cursection = sec
+	return sec, nil
+}
+
+// Decode parses the input and returns its top-level object. On error the
+// returned map is not nil and holds every key parsed before the error,
+// including partially parsed objects enclosing the error.
+func (d *Decoder) Decode() (map[string]interface{}, error) {
+	d.parse(nil, d.ucl)
+	if d.err == nil && d.strict {
+		// parse stops at the brace closing a braced top-level object
+		d.err = d.expecteof()
+	}
+
+	if d.err == io.EOF {
+		d.err = nil
+	}
+	if len(d.errs) > 0 {
+		if d.err != nil {
+			d.errs = append(d.errs, d.err)
+		}
+		d.err = DecodeErrors(d.errs)
+	}
+	if d.err == nil && (d.schema != nil || d.required != nil) {
+		var errs ValidationErrors
+		if d.schema != nil {
+			errs = d.validate(d.schema, d.ucl, "", 0)
+		}
+		for _, path := range d.required {
+			if _, ok := Get(d.ucl, path); !ok {
+				errs = append(errs, &ValidationError{Message: fmt.Sprintf(
+					"missing required key %s", path)})
+			}
+		}
+		if len(errs) > 0 {
+			d.err = errs
+		}
+	}
+	if d.err == nil && d.ordered && !d.unmarshaling {
+		for k, v := range d.ucl {
+			if k != KeyOrder {
+				d.ucl[k] = toordered(v)
+			}
+		}
+	}
+	return d.ucl, d.err
+}
+
+// DecodeOrdered parses the input like Decode but returns the top-level
+// object, and every object within it, as an OrderedMap.
+func (d *Decoder) DecodeOrdered() (*OrderedMap, error) {
+	ucl, err := d.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return toordered(ucl).(*OrderedMap), nil
+}
+
+// SourceLine returns the text of input line n, counted from 1, without its
+// newline, if it is one of the lines last read, e.g. to show where Decode
+// failed. The line being read when decoding stopped is returned as far as it
+// was read.
+func (d *Decoder) SourceLine(n int) (string, bool) {
+	return d.scanner.sourceline(n)
+}
+
+// LatestTag reports the partial token the scanner was reading, its kind and
+// the input line. After Decode fails it describes where scanning stopped,
+// which can be used to annotate the error; see Scanner.LatestTag for the
+// kinds returned.
+func (d *Decoder) LatestTag() (string, TokenKind, int) {
+	return d.scanner.LatestTag()
+}
+
+// DecodeValue parses the input and returns its top-level value: an object
+// as map[string]interface{}, an array as []interface{}, or the value of a
+// document that holds nothing but a single scalar, such as "hello", 42 or a
+// heredoc. The scalar is decoded as the value of a key would be, so it is a
+// string unless SetTypedValues or SetUseNumber applies. A lone bareword is
+// read as such a value rather than as a key without a value.
+func (d *Decoder) DecodeValue() (interface{}, error) {
+	t, err := d.nexttag()
+	if err == io.EOF {
+		return d.ucl, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch t.state {
+	case BRACKETOPEN:
+		res, err := d.parselist(nil, make([]interface{}, 0, 32))
+		if err == nil {
+			err = d.expecteof()
+		}
+		return res, err
+
+	case TAG, QUOTE, VQUOTE, SLASH, MLSTRING:
+		// a single value if only terminators follow it
+		seen := []*tag{t}
+		for {
+			nt, err := d.nexttag()
+			if err == io.EOF {
+				return d.scalar(t.val, t.state), nil
+			} else if err != nil {
+				return nil, err
+			}
+			seen = append(seen, nt)
+			if nt.state != SEMICOL {
+				break
+			}
+		}
+		d.pushback(seen...)
+
+	default:
+		d.pushback(t)
+	}
+
+	return d.Decode()
+}
+
+// expecteof fails if anything but terminators remain in the input
+func (d *Decoder) expecteof() error {
+	for {
+		t, err := d.nexttag()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if t.state != SEMICOL {
+			return fmt.Errorf("unexpected '%s' after value at line %d",
+				string(t.val), t.line)
+		}
+	}
+}
+
+// Ucl parses the input and returns its top-level object.
+//
+// Deprecated: use Decode.
+func (d *Decoder) Ucl() (map[string]interface{}, error) {
+	return d.Decode()
+}
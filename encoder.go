@@ -32,11 +32,16 @@
 package ucl
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -45,12 +50,493 @@ const (
 	parent_anon
 )
 
-type encoder struct {
-	w        io.Writer
+// Output formats supported by the Encoder
+const (
+	FormatUCL = iota
+	FormatYAML
+)
+
+// Spellings of booleans written by the Encoder
+const (
+	BoolTrueFalse = iota
+	BoolYesNo
+	BoolOnOff
+)
+
+// Styles of objects within arrays written by the Encoder
+const (
+	ArrayObjectBraces     = iota // members end at the newline
+	ArrayObjectTerminated        // members end with ';' as elsewhere
+)
+
+// Representations of nil values written by the Encoder
+const (
+	NilVerbatim = iota // the SetNilValue string as is (default)
+	NilOmitKey         // keys and fields holding nil are left out
+	NilBareword        // the SetNilValue string unquoted, or null
+	NilQuoted          // the SetNilValue string quoted
+	NilNull            // the keyword null
+)
+
+var boolWords = [...][2]string{
+	BoolTrueFalse: {"false", "true"},
+	BoolYesNo:     {"no", "yes"},
+	BoolOnOff:     {"off", "on"},
+}
+
+const (
+	DefaultIndent        = "\t"
+	DefaultTag           = "json"
+	DefaultHeredocTag    = "EOSTR" // ends strings written as <<EOSTR heredocs
+	DefaultLineSeparator = "\n"
+)
+
+// A Marshaler writes its own UCL. MarshalUCL returns the text of the value
+// as it follows a key: a scalar, an array in brackets or an object in
+// braces, with lines after the first indented relative to the key. It takes
+// precedence over encoding the value's fields or elements, but is not used
+// for YAML output. As with encoding/json, a struct embedding a Marshaler is
+// itself one through method promotion.
+type Marshaler interface {
+	MarshalUCL() ([]byte, error)
+}
+
+// A Lazy value is computed when it is encoded, by calling it and encoding
+// its result in its place; a failing call fails the encoding. A Lazy must
+// not return itself or a value containing it, directly or through other
+// Lazy values.
+type Lazy func() (interface{}, error)
+
+var lazyType = reflect.TypeOf(Lazy(nil))
+
+var numberType = reflect.TypeOf(Number(""))
+var regexType = reflect.TypeOf(Regex(""))
+var timeType = reflect.TypeOf(time.Time{})
+
+// UnixTime is the layout for times as integer seconds since the Unix epoch,
+// for Encoder.SetTimeFormat and Decoder.SetTimeLayouts.
+const UnixTime = "unix"
+
+// An Encoder writes values as UCL (or YAML) to an output stream.
+type Encoder struct {
+	w        *bufio.Writer
 	indenter string
 	newline  string
+	linesep  string
 	tag      string
 	nilval   string
+	format   int
+
+	mlthreshold int // length from which strings are always heredocs
+	inlinemax   int // longest array of scalars written on one line
+	boolstyle   int
+	needquote   func(string) bool
+	filter      func(path string, v interface{}) (interface{}, bool)
+	path        []string // keys leading to the value being encoded
+	fixnl       bool     // normalize the end of the output to trailingnl
+	trailingnl  bool
+	omitzero    bool // skip struct fields holding their zero value
+	maxwidth    int  // column at which inline arrays are wrapped
+	col         int  // column at which the value being written starts
+	objstyle    int
+	nilmode     int
+	timefmt     string
+	heredoctag  string
+
+	enums map[reflect.Type]map[int64]string
+}
+
+// NewEncoder returns an encoder writing UCL to w, indenting with
+// DefaultIndent and looking up struct keys in the DefaultTag tag. Output is
+// buffered; Encode flushes it when done.
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{w: bufio.NewWriter(w), tag: DefaultTag}
+	e.SetIndent(DefaultIndent)
+	return e
+}
+
+// SetIndent sets the string used for one level of indentation. An empty
+// indenter puts the whole document on a single line.
+func (e *Encoder) SetIndent(indenter string) {
+	e.indenter = indenter
+	e.newline = ""
+	if indenter != "" {
+		e.newline = e.eol()
+	}
+}
+
+// SetLineSeparator sets the string ending lines of UCL output,
+// DefaultLineSeparator or "\r\n". The lines of strings written as heredocs
+// still end in "\n", as part of the string.
+func (e *Encoder) SetLineSeparator(sep string) {
+	e.linesep = sep
+	e.SetIndent(e.indenter)
+}
+
+// eol returns the line separator
+func (e *Encoder) eol() string {
+	if e.linesep == "" {
+		return DefaultLineSeparator
+	}
+	return e.linesep
+}
+
+// SetTag sets the struct tag searched for a field's key.
+func (e *Encoder) SetTag(tag string) {
+	e.tag = tag
+}
+
+// SetNilValue sets the (verbatim) string representing null value in output.
+// How it is written depends on the mode set by SetNilMode.
+func (e *Encoder) SetNilValue(nilval string) {
+	e.nilval = nilval
+}
+
+// SetHeredocTag sets the tag of strings written as heredocs, as in
+// <<EOSTR, where DefaultHeredocTag is the default. It must be made of ASCII
+// letters and digits, or encoding a heredoc fails. Lines of a string that
+// would end the heredoc early are escaped, so any tag is safe to use, but
+// one that never occurs in the strings keeps them as written.
+func (e *Encoder) SetHeredocTag(tag string) {
+	e.heredoctag = tag
+}
+
+// hdtag returns the heredoc tag
+func (e *Encoder) hdtag() string {
+	if e.heredoctag == "" {
+		return DefaultHeredocTag
+	}
+	return e.heredoctag
+}
+
+// SetMultilineThreshold makes strings of at least n bytes be written as
+// heredocs even if they hold no newlines, keeping very long values
+// off a single quoted line. Zero (default) disables the length trigger.
+func (e *Encoder) SetMultilineThreshold(n int) {
+	e.mlthreshold = n
+}
+
+// SetBoolStyle selects how booleans are spelled: BoolTrueFalse (default),
+// BoolYesNo or BoolOnOff. All of them decode back to booleans with
+// Decoder.SetTypedValues. YAML output always uses true and false. Any
+// other style is ignored, keeping the current one.
+func (e *Encoder) SetBoolStyle(style int) {
+	if style >= 0 && style < len(boolWords) {
+		e.boolstyle = style
+	}
+}
+
+// SetQuotePredicate sets the function deciding whether a key or string
+// value is written quoted; nil restores the default of quoting anything
+// that is not alphanumeric. The predicate must quote every string the
+// decoder would not read back as a single bareword, e.g. ones with spaces,
+// separators, brackets or quotes, or the output will not parse. The empty
+// string is always quoted.
+func (e *Encoder) SetQuotePredicate(f func(s string) bool) {
+	e.needquote = f
+}
+
+// SetValueFilter sets a function called with the dotted path and value of
+// every scalar before it is written, e.g. "db.password" or "hosts.0" for an
+// array element. It returns the value to write in its place, such as a
+// masked secret, or false to leave the key or element out altogether.
+func (e *Encoder) SetValueFilter(f func(path string, v interface{}) (interface{}, bool)) {
+	e.filter = f
+}
+
+// SetInlineArrayThreshold makes arrays of at most n scalars be written on
+// one line, as in "ports [80, 443];". Arrays holding objects, arrays, nulls
+// or strings written as heredocs are always expanded. Zero (default) expands
+// every array.
+func (e *Encoder) SetInlineArrayThreshold(n int) {
+	e.inlinemax = n
+}
+
+// SetMaxLineWidth makes arrays written on one line, as chosen by
+// SetInlineArrayThreshold, continue on the next line, one level deeper,
+// after any comma past which they would extend beyond column n. The
+// threshold still decides which arrays are written inline: longer ones are
+// written one element per line whatever their width. Other values are
+// never split, and an element wider than n gets a line of its own. Tabs
+// count to the next multiple of 8 columns. Zero (default) sets no limit, as
+// does an empty indenter.
+func (e *Encoder) SetMaxLineWidth(n int) {
+	e.maxwidth = n
+}
+
+// RegisterEnum makes values of the integer type t be written by the names
+// in names instead of numerically, e.g. "level debug" rather than
+// "level 2". Values missing from names are still written as numbers.
+func (e *Encoder) RegisterEnum(t reflect.Type, names map[int64]string) {
+	if e.enums == nil {
+		e.enums = make(map[reflect.Type]map[int64]string)
+	}
+	e.enums[t] = names
+}
+
+// enumname looks up the registered name of an enum value
+func (e *Encoder) enumname(v reflect.Value) (string, bool) {
+	if !v.IsValid() || e.enums == nil {
+		return "", false
+	}
+	names, ok := e.enums[v.Type()]
+	if !ok {
+		return "", false
+	}
+
+	var name string
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		name, ok = names[v.Int()]
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		name, ok = names[int64(v.Uint())]
+	default:
+		ok = false
+	}
+	return name, ok
+}
+
+// SetFormat selects the output format, FormatUCL (default) or FormatYAML.
+func (e *Encoder) SetFormat(format int) {
+	e.format = format
+}
+
+// SetTrailingNewline makes the output of Encode end in exactly one newline,
+// or in none. By default it ends as the encoded value does: objects end in
+// a newline, arrays and scalars do not. Empty output is left empty.
+func (e *Encoder) SetTrailingNewline(on bool) {
+	e.fixnl = true
+	e.trailingnl = on
+}
+
+// SetArrayObjectStyle selects how the members of objects within arrays are
+// ended: ArrayObjectBraces (default) ends each at its newline, while
+// ArrayObjectTerminated ends each with ';' as members of other objects are,
+// which keeps the output valid with an empty indenter.
+func (e *Encoder) SetArrayObjectStyle(style int) {
+	e.objstyle = style
+}
+
+// SetNilMode sets how nil values, including nil pointers, maps and slices,
+// are written in UCL output. In NilVerbatim mode (default) the string set by
+// SetNilValue is written as it is, so that with none set a key holding nil
+// is written alone, as in "key;". NilOmitKey leaves such keys and struct
+// fields out altogether. NilBareword writes the string unquoted, or "null"
+// if none is set, but quotes a string that would not read back as a single
+// bareword. NilQuoted always quotes it, but writes "null" if none is set,
+// as "" would decode to an empty string, and NilNull writes "null" whatever
+// it is. Nil array elements are written as "null" when the mode would leave
+// them empty. YAML output writes nil as null unless the key is omitted.
+//
+// A key written alone decodes to nil, as does null when decoding with
+// SetTypedValues; a quoted string decodes to that string.
+func (e *Encoder) SetNilMode(mode int) {
+	e.nilmode = mode
+}
+
+// nilstr returns the text written for a nil value, empty for none
+func (e *Encoder) nilstr() string {
+	switch e.nilmode {
+	case NilBareword:
+		if e.nilval == "" {
+			return "null"
+		}
+		if !bareword(e.nilval) {
+			return strconv.Quote(e.nilval)
+		}
+	case NilQuoted:
+		if e.nilval == "" {
+			// "" would read back as an empty string
+			return "null"
+		}
+		return strconv.Quote(e.nilval)
+	case NilNull:
+		return "null"
+	}
+	return e.nilval
+}
+
+// bareword reports whether s reads back as a single unquoted value
+func bareword(s string) bool {
+	if s == "" || s[0] == '/' || strings.HasPrefix(s, "<<") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] == 0x7f ||
+			strings.IndexByte("\"'{}[];,#=:\\", s[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTimeFormat sets the layout, as for time.Time.Format, in which
+// time.Time values are written, or UnixTime for integer seconds since the
+// epoch. The default is time.RFC3339Nano. Times other than UnixTime ones are
+// quoted if they are not plain words.
+func (e *Encoder) SetTimeFormat(layout string) {
+	e.timefmt = layout
+}
+
+// SetOmitZeroValues skips every struct field holding the zero value for its
+// type, as if all fields were tagged omitempty. Embedded structs left with no
+// fields to write are dropped entirely.
+func (e *Encoder) SetOmitZeroValues(on bool) {
+	e.omitzero = on
+}
+
+// Encode writes v to the encoder's writer and flushes it.
+func (e *Encoder) Encode(v interface{}) error {
+	e.col = 0
+	if e.fixnl {
+		return e.encodeTrimmed(v)
+	}
+	if err := e.doencode(reflect.ValueOf(v), parent_map, 0); err != nil {
+		e.Flush()
+		return err
+	}
+	return e.Flush()
+}
+
+// EncodeArray writes an array whose elements are produced by fn, as Encode
+// would write a slice holding them, without collecting them first. fn calls
+// yield with each element in turn; yield writes it and returns any error
+// encoding it, which fn should return. The array is flushed once fn returns.
+// The inline array threshold does not apply, as the number of elements is
+// not known in advance.
+func (e *Encoder) EncodeArray(fn func(yield func(interface{}) error) error) error {
+	if e.format == FormatYAML {
+		return e.yamlArray(fn)
+	}
+
+	e.col = 0
+	e.w.WriteString("[")
+	n := 0
+	err := fn(func(item interface{}) error {
+		cv := reflect.ValueOf(item)
+		cv = deref(cv)
+		cv, err := lazy(cv)
+		if err != nil {
+			return err
+		}
+		key := ""
+		if e.filter != nil {
+			key = strconv.Itoa(n)
+		}
+		var ok bool
+		if cv, ok = e.filtered(cv, key); !ok {
+			return nil
+		}
+		e.push(key)
+		err = e.encodeElem(cv, n, 0, "")
+		e.pop()
+		n++
+		return err
+	})
+	if err != nil {
+		e.Flush()
+		return err
+	}
+	e.closeArray(n, "")
+	if e.fixnl && e.trailingnl {
+		e.w.WriteString(e.eol())
+	}
+	return e.Flush()
+}
+
+// encodeTrimmed encodes v into a buffer to set its trailing newline
+func (e *Encoder) encodeTrimmed(v interface{}) error {
+	var buf bytes.Buffer
+	w := e.w
+	e.w = bufio.NewWriter(&buf)
+	err := e.doencode(reflect.ValueOf(v), parent_map, 0)
+	e.w.Flush()
+	e.w = w
+
+	out := bytes.TrimRight(buf.Bytes(), "\r\n")
+	e.w.Write(out)
+	if e.trailingnl && len(out) > 0 {
+		e.w.WriteString(e.eol())
+	}
+	if err != nil {
+		e.Flush()
+		return err
+	}
+	return e.Flush()
+}
+
+// EncodeOrdered writes m with its keys in the given order, without the
+// caller having to store a KeyOrder entry in m. Keys of m missing from order
+// follow in sorted order, and keys in order that m lacks are skipped. The
+// order argument takes precedence over any KeyOrder entry of m; nested maps
+// still use their own KeyOrder.
+func (e *Encoder) EncodeOrdered(m map[string]interface{}, order []string) error {
+	om := make(map[string]interface{}, len(m)+1)
+	seen := make(map[string]bool, len(order))
+	keys := make([]string, 0, len(m))
+	for _, k := range order {
+		if _, ok := m[k]; ok && k != KeyOrder && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	rest := len(keys)
+	for k, v := range m {
+		if k == KeyOrder {
+			continue
+		}
+		om[k] = v
+		if !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys[rest:])
+	om[KeyOrder] = keys
+	return e.Encode(om)
+}
+
+// EncodeToString returns v encoded with the encoder's settings, leaving its
+// writer untouched. On error the output written so far is returned.
+func (e *Encoder) EncodeToString(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	se := *e
+	se.w = bufio.NewWriter(&buf)
+	err := se.Encode(v)
+	return buf.String(), err
+}
+
+// Flush writes any buffered output to the underlying writer, returning the
+// first write error encountered.
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// EncodeToString returns v encoded as UCL with the default settings.
+func EncodeToString(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(v)
+	return buf.String(), err
+}
+
+// Format decodes the UCL document src and writes it back out in canonical
+// form: one statement per line, keys in their original order and strings
+// quoted only where needed. The indentation and line separator of src, as
+// found by DetectStyle, are kept. Comments are not kept.
+func Format(src []byte) ([]byte, error) {
+	v, err := NewDecoder(bytes.NewReader(src)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	indent, sep := DetectStyle(src)
+	e.SetIndent(indent)
+	e.SetLineSeparator(sep)
+	if err = e.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // Encode v as UCL.
@@ -58,26 +544,35 @@ type encoder struct {
 // tag = if v has struct components, then use tag to search for the tag's key
 // nilval = (verbatim) string representing null value in output
 func Encode(w io.Writer, v interface{}, indenter, tag, nilval string) error {
-	newline := ""
-	if indenter != "" {
-		newline = "\n"
-	}
-
-	e := &encoder{w, indenter, newline, tag, nilval}
-	return e.doencode(reflect.ValueOf(v), parent_map, 0)
+	e := NewEncoder(w)
+	e.SetIndent(indenter)
+	e.SetTag(tag)
+	e.SetNilValue(nilval)
+	return e.Encode(v)
 }
 
-func (e *encoder) doencode(v reflect.Value, parenttype, indent int) error {
+func (e *Encoder) doencode(v reflect.Value, parenttype, indent int) error {
 	var indents string
 	for i := 0; i < indent; i++ {
 		indents += e.indenter
 	}
 
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
+	v = deref(v)
+
+	v, err := lazy(v)
+	if err != nil {
+		return err
 	}
-	if v.Kind() == reflect.Interface {
-		v = v.Elem()
+
+	if e.format == FormatYAML {
+		return e.yamlEncode(v, indent)
+	}
+
+	if m, ok := marshaler(v); ok {
+		return e.encodeMarshaler(m, parenttype, indents)
+	}
+	if _, ok := bignum(v); ok || istime(v) {
+		return e.encodeScalar(v, parenttype, indent)
 	}
 
 	switch v.Kind() {
@@ -95,9 +590,23 @@ func (e *encoder) doencode(v reflect.Value, parenttype, indent int) error {
 	}
 }
 
-// quote all strings that have non-alphanum
+// str quotes s if the quote predicate, or by default encodeStr, asks for it
+func (e *Encoder) str(s string) string {
+	if e.needquote == nil {
+		return encodeStr(s)
+	}
+	if s == "" || e.needquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// quote all strings that have non-alphanum, and the empty string
 func encodeStr(s string) string {
 	qs := strconv.Quote(s)
+	if s == "" {
+		return qs
+	}
 	for i := 1; i < len(qs)-1; i++ {
 		if !((qs[i] >= 'A' && qs[i] <= 'Z') ||
 			(qs[i] >= 'a' && qs[i] <= 'z') ||
@@ -108,136 +617,433 @@ func encodeStr(s string) string {
 	return s
 }
 
-func (e *encoder) encodeMap(v reflect.Value, parenttype, indent int) (err error) {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
+// filtered passes the scalar cv, found under key, through the value filter
+func (e *Encoder) filtered(cv reflect.Value, key string) (reflect.Value, bool) {
+	if e.filter == nil {
+		return cv, true
+	}
+	switch cv.Kind() {
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		if _, ok := bignum(cv); !ok && !istime(cv) {
+			return cv, true
+		}
 	}
+	var v interface{}
+	if cv.IsValid() && cv.CanInterface() {
+		v = cv.Interface()
+	}
+	path := strings.Join(append(e.path[:len(e.path):len(e.path)], key), ".")
+	v, ok := e.filter(path, v)
+	return reflect.ValueOf(v), ok
+}
 
-	// test if keyorder key exist
-	mv := v.MapIndex(reflect.ValueOf(KeyOrder))
-	if mv.Kind() != 0 {
-		if korder, ok := mv.Interface().([]string); ok {
-			for i := range korder {
-				if i > 0 {
-					fmt.Fprintf(e.w, e.newline)
-				}
-				fmt.Fprintf(e.w, "%s%s", indents, encodeStr(korder[i]))
+// push and pop track the path of the value being encoded for the filter
+func (e *Encoder) push(key string) {
+	if e.filter != nil {
+		e.path = append(e.path, key)
+	}
+}
 
-				cv := v.MapIndex(reflect.ValueOf(korder[i]))
-				if cv.Kind() == reflect.Ptr {
-					cv = cv.Elem()
-				}
-				if cv.Kind() == reflect.Interface {
-					cv = cv.Elem()
-				}
-				if cv.Kind() != reflect.Invalid {
-					fmt.Fprintf(e.w, " ")
-				}
+func (e *Encoder) pop() {
+	if e.filter != nil {
+		e.path = e.path[:len(e.path)-1]
+	}
+}
 
-				switch cv.Kind() {
-				case reflect.Slice, reflect.Array:
-					err = e.doencode(cv, parent_map, indent)
-				case reflect.Map, reflect.Struct:
-					fmt.Fprintf(e.w, "{%s", e.newline)
-					err = e.doencode(cv, parent_map, indent+1)
-					fmt.Fprintf(e.w, "%s}", indents)
-				default:
-					err = e.doencode(cv, parent_map, indent+1)
-				}
-				if err != nil {
-					break
-				}
-				if parenttype != parent_array {
-					fmt.Fprintf(e.w, ";")
-				}
-			}
-			if err == nil && len(korder) > 0 {
-				fmt.Fprintf(e.w, e.newline)
-			}
-			return err
+// deref follows pointers and interfaces to the value they hold. A nil one
+// gives an invalid Value, written as null, so a nil *map is told apart from
+// a pointer to an empty map, which is written as {}.
+func deref(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return v
+}
+
+// lazy calls v if it is a Lazy, returning the value it computes, and
+// turns an OrderedMap into a map with a KeyOrder entry
+func lazy(v reflect.Value) (reflect.Value, error) {
+	if v.Kind() == reflect.Ptr && v.Type().Elem() == orderedMapType {
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Type() == orderedMapType && v.CanInterface() {
+		m := v.Interface().(OrderedMap)
+		return reflect.ValueOf(m.keymap()), nil
+	}
+	if v.Kind() != reflect.Func || !v.Type().ConvertibleTo(lazyType) ||
+		!v.CanInterface() {
+		return v, nil
+	}
+	if v.IsNil() {
+		return reflect.Value{}, nil
+	}
+	res, err := v.Convert(lazyType).Interface().(Lazy)()
+	if err != nil {
+		return v, err
+	}
+	v = reflect.ValueOf(res)
+	v = deref(v)
+	return lazy(v)
+}
+
+// bignum returns the text of a big.Int, big.Float or big.Rat, with floats
+// in the shortest form that reads back as the same value
+func bignum(v reflect.Value) (string, bool) {
+	if !v.IsValid() || v.Kind() != reflect.Struct || !v.CanInterface() {
+		return "", false
+	}
+	switch n := v.Interface().(type) {
+	case big.Int:
+		return n.String(), true
+	case big.Float:
+		return n.Text('g', -1), true
+	case big.Rat:
+		return n.RatString(), true
+	}
+	return "", false
+}
+
+// opaque reports whether the map or struct v is written as a whole rather
+// than by its fields
+func opaque(v reflect.Value) bool {
+	if _, ok := marshaler(v); ok {
+		return true
+	}
+	_, ok := bignum(v)
+	return ok || istime(v)
+}
+
+// istime reports whether v is a time.Time, written as a scalar
+func istime(v reflect.Value) bool {
+	return v.IsValid() && v.Type() == timeType && v.CanInterface()
+}
+
+// timetext formats the time v as set by SetTimeFormat, reporting whether
+// it is unquoted
+func (e *Encoder) timetext(v reflect.Value) (string, bool) {
+	t := v.Interface().(time.Time)
+	switch e.timefmt {
+	case "":
+		return t.Format(time.RFC3339Nano), false
+	case UnixTime:
+		return strconv.FormatInt(t.Unix(), 10), true
+	}
+	return t.Format(e.timefmt), false
+}
+
+// marshaler returns v as a Marshaler if it, or its address, implements it
+func marshaler(v reflect.Value) (Marshaler, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	if v.CanInterface() {
+		if m, ok := v.Interface().(Marshaler); ok {
+			return m, true
 		}
 	}
-	keys := v.MapKeys()
-	for i := range keys {
+	if v.CanAddr() && v.Addr().CanInterface() {
+		if m, ok := v.Addr().Interface().(Marshaler); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// encodeMarshaler writes the output of m, indenting its lines after the
+// first with indents
+func (e *Encoder) encodeMarshaler(m Marshaler, parenttype int,
+	indents string) error {
+
+	b, err := m.MarshalUCL()
+	if err != nil {
+		return err
+	}
+	if parenttype == parent_array {
+		e.w.WriteString(indents)
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	for i, l := range lines {
 		if i > 0 {
-			fmt.Fprintf(e.w, e.newline)
+			e.w.WriteString(e.newline)
+			if l != "" {
+				e.w.WriteString(indents)
+			}
 		}
-		fmt.Fprintf(e.w, "%s%s", indents,
-			encodeStr(keys[i].Interface().(string)))
+		e.w.WriteString(l)
+	}
+	return nil
+}
 
-		cv := v.MapIndex(keys[i])
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
+// emptyobject reports whether the map or struct v has nothing to encode, so
+// that it can be written as {} on one line
+func (e *Encoder) emptyobject(v reflect.Value) bool {
+	if v.Kind() == reflect.Struct {
+		return e.emptystruct(v)
+	}
+	for _, k := range v.MapKeys() {
+		if k.Kind() == reflect.String && k.String() == KeyOrder {
+			continue
 		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
+		if !e.omitted(deref(v.MapIndex(k))) {
+			return false
 		}
-		if cv.Kind() != reflect.Invalid {
-			fmt.Fprintf(e.w, " ")
+	}
+	return true
+}
+
+// emptystruct reports whether encodeStruct writes no field of v, skipping
+// fields as it does
+func (e *Encoder) emptystruct(v reflect.Value) bool {
+	for i := 0; i < v.NumField(); i++ {
+		cv := v.Field(i)
+		sf := v.Type().Field(i)
+
+		if e.omitzero && !sf.Anonymous && cv.IsZero() {
+			continue
+		}
+		cv = deref(cv)
+		if sf.Anonymous {
+			if cv.Kind() == reflect.Invalid {
+				continue
+			}
+			if cv.Kind() == reflect.Struct && !e.emptystruct(cv) {
+				return false
+			}
 		}
 
-		switch cv.Kind() {
-		case reflect.Slice, reflect.Array:
-			err = e.doencode(cv, parent_map, indent)
-		case reflect.Map, reflect.Struct:
-			fmt.Fprintf(e.w, "{%s", e.newline)
-			err = e.doencode(cv, parent_map, indent+1)
-			fmt.Fprintf(e.w, "%s}", indents)
-		default:
-			err = e.doencode(cv, parent_map, indent+1)
+		tag := sf.Tag.Get(e.tag)
+		if tag == "-" || tagopt(tag, "keyorder") {
+			continue
+		}
+		if tag == "" && (sf.Name[0] < 'A' || sf.Name[0] > 'Z') {
+			continue
+		}
+		if !e.omitted(cv) {
+			return false
+		}
+	}
+	return true
+}
+
+// omitted reports whether a key holding the dereferenced value cv is left
+// out of the output
+func (e *Encoder) omitted(cv reflect.Value) bool {
+	return cv.Kind() == reflect.Invalid && e.nilmode == NilOmitKey
+}
+
+func (e *Encoder) encodeMap(v reflect.Value, parenttype, indent int) (err error) {
+	var indents string
+	for i := 0; i < indent; i++ {
+		indents += e.indenter
+	}
+
+	// the keys in KeyOrder if it exists, otherwise as the map holds them
+	var keys []string
+	ok := false
+	mv := v.MapIndex(reflect.ValueOf(KeyOrder).Convert(v.Type().Key()))
+	if mv.IsValid() {
+		keys, ok = mv.Interface().([]string)
+	}
+	if !ok {
+		for _, k := range v.MapKeys() {
+			if k.String() != KeyOrder {
+				keys = append(keys, k.String())
+			}
+		}
+	}
+
+	n := 0
+	for _, k := range keys {
+		cv := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		if !cv.IsValid() {
+			// listed but not in the map, unlike a nil entry
+			continue
+		}
+		if cv, err = lazy(deref(cv)); err != nil {
+			return err
+		}
+		var wrote bool
+		if wrote, err = e.encodeKey(k, e.str(k), cv, n, indent,
+			indents); !wrote {
+			continue
 		}
+		n++
 		if err != nil {
 			break
 		}
-		if parenttype != parent_array {
-			fmt.Fprintf(e.w, ";")
+		if parenttype != parent_array ||
+			e.objstyle == ArrayObjectTerminated {
+			e.w.WriteString(";")
 		}
 	}
-	if err == nil && len(keys) > 0 {
-		fmt.Fprintf(e.w, e.newline)
+	if err == nil && n > 0 {
+		e.w.WriteString(e.newline)
 	}
-
 	return err
 }
 
-func (e *encoder) encodeStruct(v reflect.Value, parenttype, indent int) (err error) {
+// encodeKey writes the member key of an object, spelled out, holding cv,
+// after n members at the given indentation. It reports whether it wrote
+// it, as the value filter and the nil mode may leave it out.
+func (e *Encoder) encodeKey(key, out string, cv reflect.Value, n, indent int,
+	indents string) (bool, error) {
+
+	cv, ok := e.filtered(cv, key)
+	if !ok || e.omitted(cv) {
+		return false, nil
+	}
+	if n > 0 {
+		e.w.WriteString(e.newline)
+	}
+	fmt.Fprintf(e.w, "%s%s", indents, out)
+	e.startcol(indents + out + " ")
+
+	if cv.Kind() != reflect.Invalid || e.nilstr() != "" {
+		e.w.WriteString(" ")
+	}
+	e.push(key)
+	err := e.encodeValue(cv, parent_map, indent, indents)
+	e.pop()
+	return true, err
+}
+
+// encodeValue writes cv, the value of a key or an element of an array, at
+// the given indentation. Elements start with the indentation, values of
+// keys follow the key.
+func (e *Encoder) encodeValue(cv reflect.Value, parenttype, indent int,
+	indents string) error {
+
+	lead := ""
+	if parenttype == parent_array {
+		lead = indents
+	}
+	switch cv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if parenttype == parent_array {
+			e.w.WriteString(lead)
+			e.startcol(lead)
+		}
+		return e.doencode(cv, parenttype, indent)
+	case reflect.Map, reflect.Struct:
+		if opaque(cv) {
+			break
+		}
+		if e.emptyobject(cv) {
+			fmt.Fprintf(e.w, "%s{}", lead)
+			return nil
+		}
+		fmt.Fprintf(e.w, "%s{%s", lead, e.newline)
+		err := e.doencode(cv, parenttype, indent+1)
+		fmt.Fprintf(e.w, "%s}", indents)
+		return err
+	}
+	// scalars in arrays write their own indentation
+	return e.doencode(cv, parenttype, indent)
+}
+
+// fieldorder returns the indexes of the fields of struct v in the order
+// they are encoded. A []string field with the "keyorder" tag option, as in
+// `json:",keyorder"`, lists keys to write first, in its order, such as the
+// keys of the document the struct was unmarshaled from; the other fields
+// follow in declaration order. The keyorder field itself is not encoded,
+// and the fields of embedded structs are not reordered.
+func (e *Encoder) fieldorder(v reflect.Value) []int {
+	t := v.Type()
+	order := make([]int, 0, t.NumField())
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !tagopt(sf.Tag.Get(e.tag), "keyorder") {
+			order = append(order, i)
+		} else if keys == nil && sf.Type == reflect.TypeOf(keys) {
+			keys = make([]string, v.Field(i).Len())
+			for j := range keys {
+				keys[j] = v.Field(i).Index(j).String()
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return order
+	}
+
+	rank := make(map[string]int, len(keys))
+	for j := len(keys) - 1; j >= 0; j-- {
+		rank[keys[j]] = j
+	}
+	pos := func(i int) int {
+		sf := t.Field(i)
+		if sf.Anonymous {
+			return len(keys)
+		}
+		key := sf.Name
+		if name := strings.SplitN(sf.Tag.Get(e.tag), ",", 2)[0]; name != "" {
+			key = name
+		}
+		if j, ok := rank[key]; ok {
+			return j
+		}
+		return len(keys)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return pos(order[a]) < pos(order[b])
+	})
+	return order
+}
+
+// tagopt reports whether struct tag value tag has option opt
+func tagopt(tag, opt string) bool {
+	opts := strings.Split(tag, ",")
+	for _, o := range opts[1:] {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Encoder) encodeStruct(v reflect.Value, parenttype, indent int) (err error) {
 	var indents string
 	for i := 0; i < indent; i++ {
 		indents += e.indenter
 	}
 
-	nfields := v.Type().NumField()
 	cnt := 0
-	nonl := false
-	for i := 0; i < nfields; i++ {
-		if cnt > 0 && !nonl {
-			fmt.Fprintf(e.w, e.newline)
-		}
-		nonl = false
-
+	for _, i := range e.fieldorder(v) {
 		cv := v.Field(i)
 		sf := v.Type().Field(i)
 
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
+		if e.omitzero && !sf.Anonymous && cv.IsZero() {
+			continue
 		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
+		cv = deref(cv)
+		if cv, err = lazy(cv); err != nil {
+			return err
 		}
 		if sf.Anonymous {
 			if cv.Kind() == reflect.Invalid {
-				nonl = true
 				continue
 			}
 
-			// Drill down into anonymous field and attempt encoding of it
+			// Drill down into anonymous field and attempt encoding of it,
+			// buffered so that a field with nothing to write leaves no
+			// blank line behind
+			var buf bytes.Buffer
+			w := e.w
+			e.w = bufio.NewWriter(&buf)
 			err = e.encodeStruct(cv, parent_anon, indent)
+			e.w.Flush()
+			e.w = w
 			if err != nil {
 				return err
 			}
+			if buf.Len() > 0 {
+				if cnt > 0 {
+					e.w.WriteString(e.newline)
+				}
+				e.w.Write(buf.Bytes())
+				cnt++
+			}
 		}
-		cnt++
 
 		tag := sf.Tag.Get(e.tag)
 		if tag == "-" {
@@ -245,91 +1051,251 @@ func (e *encoder) encodeStruct(v reflect.Value, parenttype, indent int) (err err
 			continue
 		}
 
+		key, out := sf.Name, sf.Name
 		if tag == "" {
-			if sf.Name[0] >= 'A' && sf.Name[0] <= 'Z' {
-				fmt.Fprintf(e.w, "%s%s", indents, sf.Name)
-			} else {
+			if sf.Name[0] < 'A' || sf.Name[0] > 'Z' {
 				continue
 			}
 		} else {
 			// split at "," and get first
-			fmt.Fprintf(e.w, "%s%s", indents,
-				encodeStr(strings.SplitN(tag, ",", 2)[0]))
-		}
-
-		if cv.Kind() != reflect.Invalid {
-			fmt.Fprintf(e.w, " ")
+			key = strings.SplitN(tag, ",", 2)[0]
+			out = e.str(key)
 		}
 
-		switch cv.Kind() {
-		case reflect.Slice, reflect.Array:
-			err = e.doencode(cv, parent_map, indent)
-		case reflect.Map, reflect.Struct:
-			fmt.Fprintf(e.w, "{%s", e.newline)
-			err = e.doencode(cv, parent_map, indent+1)
-			fmt.Fprintf(e.w, "%s}", indents)
-		default:
-			err = e.doencode(cv, parent_map, indent+1)
+		var wrote bool
+		if wrote, err = e.encodeKey(key, out, cv, cnt, indent,
+			indents); !wrote {
+			continue
 		}
+		cnt++
 		if err != nil {
 			break
 		}
-		fmt.Fprintf(e.w, ";")
+		e.w.WriteString(";")
 	}
-	if err == nil && nfields > 0 && parenttype != parent_array &&
-		parenttype != parent_anon {
-		fmt.Fprintf(e.w, e.newline)
+	if err == nil && cnt > 0 && parenttype != parent_anon {
+		e.w.WriteString(e.newline)
 	}
 
 	return err
 }
 
-func (e *encoder) encodeSlice(v reflect.Value, parenttype, indent int) (err error) {
+func (e *Encoder) encodeSlice(v reflect.Value, parenttype, indent int) (err error) {
 	var indents string
 	for i := 0; i < indent; i++ {
 		indents += e.indenter
 	}
 
-	fmt.Fprintf(e.w, "[")
+	// the elements left by the value filter, with their keys
+	var elems []reflect.Value
+	var keys []string
 	for i := 0; i < v.Len(); i++ {
-		if i == 0 {
-			fmt.Fprintf(e.w, e.newline)
-		} else {
-			fmt.Fprintf(e.w, ",%s", e.newline)
-		}
-
 		cv := v.Index(i)
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
+		cv = deref(cv)
+		if cv, err = lazy(cv); err != nil {
+			return err
+		}
+		key := ""
+		if e.filter != nil {
+			key = strconv.Itoa(i)
 		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
+		var ok bool
+		if cv, ok = e.filtered(cv, key); !ok {
+			continue
 		}
+		elems = append(elems, cv)
+		keys = append(keys, key)
+	}
 
-		switch cv.Kind() {
-		case reflect.Slice, reflect.Array:
-			err = e.doencode(cv, parent_array, indent)
-		case reflect.Map, reflect.Struct:
-			fmt.Fprintf(e.w, "%s%s{%s", e.indenter, indents, e.newline)
-			err = e.doencode(cv, parent_array, indent+2)
-			fmt.Fprintf(e.w, "%s%s}", e.indenter, indents)
-		default:
-			err = e.doencode(cv, parent_array, indent+1)
+	if e.inline(elems) {
+		col := e.col
+		var texts []string
+		var buf bytes.Buffer
+		w := e.w
+		e.w = bufio.NewWriter(&buf)
+		for _, cv := range elems {
+			if err = e.encodeScalar(cv, parent_array, 0); err != nil {
+				break
+			}
+			e.w.Flush()
+			texts = append(texts, buf.String())
+			buf.Reset()
 		}
+		e.w = w
+		e.writeinline(texts, col, indents)
+		return err
+	}
+
+	e.w.WriteString("[")
+	n := 0
+	for i, cv := range elems {
+		e.push(keys[i])
+		err = e.encodeElem(cv, n, indent, indents)
+		e.pop()
+		n++
 		if err != nil {
 			break
 		}
 	}
-	if v.Len() > 0 {
-		fmt.Fprintf(e.w, e.newline)
+	e.closeArray(n, indents)
+	return err
+}
+
+// encodeElem writes cv as element n of an array written one element per
+// line at the given indentation
+func (e *Encoder) encodeElem(cv reflect.Value, n, indent int,
+	indents string) error {
+
+	if n == 0 {
+		e.w.WriteString(e.newline)
+	} else {
+		fmt.Fprintf(e.w, ",%s", e.newline)
+	}
+	return e.encodeValue(cv, parent_array, indent+1, e.indenter+indents)
+}
+
+// closeArray ends an array of n elements written by encodeElem
+func (e *Encoder) closeArray(n int, indents string) {
+	if n > 0 {
+		e.w.WriteString(e.newline)
 		fmt.Fprintf(e.w, "%s]", indents)
 	} else {
-		fmt.Fprintf(e.w, "]")
+		e.w.WriteString("]")
 	}
-	return err
 }
 
-func (e *encoder) encodeScalar(v reflect.Value, parenttype, indent int) (err error) {
+// writeinline writes the elements of an array on one line starting at
+// column col, breaking it after a comma where it would exceed the maximum
+// width, with the following elements indented one level below indents
+func (e *Encoder) writeinline(elems []string, col int, indents string) {
+	e.w.WriteString("[")
+	col++
+	for i, s := range elems {
+		if i > 0 {
+			e.w.WriteString(",")
+			col++
+			// room for the element and the ',' or "];" after it
+			end := 1
+			if i == len(elems)-1 {
+				end = 2
+			}
+			if e.maxwidth > 0 && e.newline != "" &&
+				col+1+len(s)+end > e.maxwidth {
+				e.w.WriteString(e.newline + indents + e.indenter)
+				col = columns(indents + e.indenter)
+			} else {
+				e.w.WriteString(" ")
+				col++
+			}
+		}
+		e.w.WriteString(s)
+		col += len(s)
+	}
+	e.w.WriteString("]")
+}
+
+// startcol records that the value written next starts after prefix on its
+// line, for SetMaxLineWidth
+func (e *Encoder) startcol(prefix string) {
+	if e.maxwidth > 0 {
+		e.col = columns(prefix)
+	}
+}
+
+// columns returns the width of s, counting tabs to the next multiple of 8
+func columns(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\t' {
+			n += 8 - n%8
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// inline reports whether the array of elems is short enough and simple
+// enough to be written on one line
+func (e *Encoder) inline(elems []reflect.Value) bool {
+	if len(elems) == 0 || len(elems) > e.inlinemax {
+		return false
+	}
+	for _, cv := range elems {
+		cv = deref(cv)
+		if _, ok := marshaler(cv); ok {
+			return false
+		}
+		if _, ok := bignum(cv); ok || istime(cv) {
+			continue
+		}
+		switch cv.Kind() {
+		case reflect.Invalid, reflect.Map, reflect.Struct,
+			reflect.Slice, reflect.Array, reflect.Func:
+			return false
+		case reflect.String:
+			if _, ok := e.enumname(cv); !ok && e.heredoc(cv.String()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// heredoc reports whether the string s is written as a heredoc: if it has
+// more than 3 newlines and is longer than 160 characters, or reaches the
+// multiline threshold
+func (e *Encoder) heredoc(s string) bool {
+	if e.mlthreshold > 0 && len(s) >= e.mlthreshold {
+		return true
+	}
+	if len(s) <= 160 {
+		return false
+	}
+	nl := 0
+	for i := range s {
+		if s[i] == '\n' {
+			nl++
+			if nl > 3 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// escapeheredoc adds a backslash to the lines of s that would end a heredoc
+// with the given tag, the tag and backslashes before it up to the end of
+// the line or a ';', which the decoder drops
+func escapeheredoc(s, tag string) string {
+	if !strings.Contains(s, tag) {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if j := strings.IndexByte(l, ';'); j >= 0 {
+			l = l[:j]
+		}
+		if strings.TrimLeft(l, "\\") == tag {
+			lines[i] = "\\" + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// heredoctag reports whether tag can end a heredoc
+func heredoctag(tag string) bool {
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return tag != ""
+}
+
+func (e *Encoder) encodeScalar(v reflect.Value, parenttype, indent int) (err error) {
 	var indents string
 	for i := 0; i < indent; i++ {
 		indents += e.indenter
@@ -343,45 +1309,74 @@ func (e *encoder) encodeScalar(v reflect.Value, parenttype, indent int) (err err
 		v = v.Elem()
 	}
 
+	if name, ok := e.enumname(v); ok {
+		e.w.WriteString(e.str(name))
+		return nil
+	}
+	if v.IsValid() && v.Type() == numberType && v.Len() > 0 {
+		e.w.WriteString(v.String())
+		return nil
+	}
+	if v.IsValid() && v.Type() == regexType {
+		e.w.WriteString(Regex(v.String()).text())
+		return nil
+	}
+	if istime(v) {
+		if s, bare := e.timetext(v); bare {
+			e.w.WriteString(s)
+		} else {
+			e.w.WriteString(e.str(s))
+		}
+		return nil
+	}
+	if s, ok := bignum(v); ok {
+		if looksnumeric(s) && strings.IndexByte(s, '/') < 0 {
+			e.w.WriteString(s)
+		} else {
+			e.w.WriteString(strconv.Quote(s))
+		}
+		return nil
+	}
+
 	switch v.Kind() {
 	case reflect.Bool:
-		fmt.Fprintf(e.w, "%t", v.Bool())
+		if v.Bool() {
+			e.w.WriteString(boolWords[e.boolstyle][1])
+		} else {
+			e.w.WriteString(boolWords[e.boolstyle][0])
+		}
 	case reflect.String:
 		mlstring := false
 		s := v.String()
-		nl := 0
-		// push as multiline string if there are more than 3 newlines and
-		// string is longer than 160 characters
-		if len(s) > 160 {
-			for i := range s {
-				if s[i] == '\n' {
-					nl++
-					if nl > 3 {
-						break
-					}
-				}
+		if e.heredoc(s) {
+			if !heredoctag(e.hdtag()) {
+				return fmt.Errorf("heredoc tag %q is not made of letters "+
+					"and digits", e.hdtag())
 			}
-		}
-		if nl > 3 {
 			mlstring = true
-			fmt.Fprintf(e.w, "<<EOSTR\n")
+			fmt.Fprintf(e.w, "<<%s\n", e.hdtag())
 		} else if len(s) == 0 {
 			fmt.Fprintf(e.w, `""`)
 			break
 		} else if s[0] != '/' {
-			fmt.Fprintf(e.w, encodeStr(s))
+			e.w.WriteString(e.str(s))
 			break
 		}
 
+		if mlstring {
+			s = escapeheredoc(s, e.hdtag())
+		}
 		fmt.Fprintf(e.w, "%s", s)
 		if mlstring {
-			fmt.Fprintf(e.w, "\nEOSTR")
+			fmt.Fprintf(e.w, "\n%s", e.hdtag())
 		}
 
 	case reflect.Invalid:
-		if e.nilval != "" {
-			fmt.Fprintf(e.w, " %s", e.nilval)
+		s := e.nilstr()
+		if s == "" && parenttype == parent_array {
+			s = "null"
 		}
+		e.w.WriteString(s)
 
 	default:
 		fmt.Fprintf(e.w, "%v", v.Interface())
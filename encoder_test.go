@@ -0,0 +1,1537 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeYAML(t *testing.T) {
+	s := `
+name server;
+ports [ 80, 443 ];
+empty {}
+section {
+	motd "hello
+world
+";
+	"key: colon" "true";
+	hosts [
+		{ host a; port 1 },
+		{ host b; port 2 }
+	];
+}
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	u, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err = e.Encode(u); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `name: server
+ports:
+  - "80"
+  - "443"
+empty: {}
+section:
+  motd: |
+    hello
+    world
+  "key: colon": "true"
+  hosts:
+    - host: a
+      port: "1"
+    - host: b
+      port: "2"
+`
+	if buf.String() != expect {
+		t.Errorf("unexpected YAML:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+}
+
+func TestEncodeYAMLStruct(t *testing.T) {
+	type inner struct {
+		D []int `json:"d"`
+	}
+	var ss struct {
+		A    int    `json:"a"`
+		B    string `json:"b"`
+		Skip string `json:"-"`
+		C    inner  `json:"c"`
+		M    [][]string
+		Nil  *int `json:"nil"`
+	}
+	ss.A = 3
+	ss.B = "line1\nline2"
+	ss.C.D = []int{1, 2}
+	ss.M = [][]string{{"x", "y"}, {}}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err := e.Encode(&ss); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `a: 3
+b: |-
+  line1
+  line2
+c:
+  d:
+    - 1
+    - 2
+M:
+  - - x
+    - "y"
+  - []
+nil: null
+`
+	if buf.String() != expect {
+		t.Errorf("unexpected YAML:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+}
+
+// counts the calls to Write, standing in for syscalls on an unbuffered conn
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func BenchmarkEncodeLarge(b *testing.B) {
+	type item struct {
+		Name  string            `json:"name"`
+		Ports []int             `json:"ports"`
+		Attrs map[string]string `json:"attrs"`
+	}
+	items := make([]item, 1000)
+	for i := range items {
+		items[i] = item{"item", []int{80, 443}, map[string]string{"k": "v"}}
+	}
+	v := map[string]interface{}{"items": items}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var w writeCounter
+	for n := 0; n < b.N; n++ {
+		if err := NewEncoder(&w).Encode(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func TestEncodeMultilineThreshold(t *testing.T) {
+	long := strings.Repeat("0123456789 \"quoted\" ", 520)[:10240]
+	v := map[string]interface{}{"blob": long, "short": "abc def"}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMultilineThreshold(1024)
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "blob <<EOSTR\n0123456789") {
+		t.Error("long string not written as heredoc")
+	}
+	if !strings.Contains(out, `short "abc def"`) {
+		t.Error("short string not quoted")
+	}
+
+	ucl, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["blob"] != long {
+		t.Error("heredoc did not round-trip")
+	}
+}
+
+type testLevel int
+
+func TestEncodeEnum(t *testing.T) {
+	var ss struct {
+		Level testLevel   `json:"level"`
+		Other testLevel   `json:"other"`
+		Plain int         `json:"plain"`
+		List  []testLevel `json:"list"`
+	}
+	ss.Level = 2
+	ss.Other = 9
+	ss.Plain = 2
+	ss.List = []testLevel{0, 1}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetIndent(" ")
+	names := map[int64]string{0: "error", 1: "warn info", 2: "debug"}
+	e.RegisterEnum(reflect.TypeOf(testLevel(0)), names)
+	if err := e.Encode(&ss); err != nil {
+		t.Fatal(err)
+	}
+	expect := "level debug;\nother 9;\nplain 2;\nlist [\n error,\n \"warn info\"\n];\n"
+	if buf.String() != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+
+	// the same table reads the names back
+	again := ss
+	again.Level, again.Other, again.Plain, again.List = 0, 0, 0, nil
+	d := NewDecoder(&buf)
+	d.RegisterEnum(reflect.TypeOf(testLevel(0)), names)
+	if err := d.Unmarshal(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, ss) {
+		t.Errorf("decoded %+v, expected %+v", again, ss)
+	}
+
+	d = NewDecoder(bytes.NewBufferString("level trace;\n"))
+	d.RegisterEnum(reflect.TypeOf(testLevel(0)), names)
+	if err := d.Unmarshal(&again); err == nil {
+		t.Error("expected error for an unknown name")
+	}
+}
+
+func TestEncodeNestedKeyOrder(t *testing.T) {
+	s := `
+zeta 1;
+outer {
+	yb 1;
+	mid {
+		xc 1;
+		inner {
+			wd 1;
+			ad 2;
+			md 3;
+		}
+		ac 2;
+	}
+	ab 2;
+}
+alpha 2;
+`
+	ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(ucl); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	last := -1
+	for _, k := range []string{"zeta", "outer", "yb", "mid", "xc",
+		"inner", "wd", "ad", "md", "ac", "ab", "alpha"} {
+		i := strings.Index(out, k+" ")
+		if i <= last {
+			t.Fatalf("%q out of order in:\n%s", k, out)
+		}
+		last = i
+	}
+
+	again, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][]string{{}, {"outer"}, {"outer", "mid"},
+		{"outer", "mid", "inner"}} {
+		m, n := ucl, again
+		for _, k := range path {
+			m = m[k].(map[string]interface{})
+			n = n[k].(map[string]interface{})
+		}
+		if !reflect.DeepEqual(m[KeyOrder], n[KeyOrder]) {
+			t.Errorf("%v: key order %v, expected %v", path,
+				n[KeyOrder], m[KeyOrder])
+		}
+	}
+}
+
+func TestEncodeOrdered(t *testing.T) {
+	m := map[string]interface{}{
+		"c": "3", "a": "1", "b": "2", "z": "26",
+		KeyOrder: []string{"a", "b", "c", "z"},
+	}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeOrdered(m, []string{"z", "missing", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expect := "z 26;\nb 2;\na 1;\nc 3;\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+	if len(m) != 5 {
+		t.Error("map was modified")
+	}
+}
+
+func TestEncodeInlineArray(t *testing.T) {
+	tests := []struct {
+		v      interface{}
+		expect string
+	}{
+		{[]int{80, 443}, "a [80, 443];\n"},
+		{[]int{1, 2, 3}, "a [1, 2, 3];\n"},
+		{[]interface{}{"x y", true, 1.5}, "a [\"x y\", true, 1.5];\n"},
+		{[]int{1, 2, 3, 4}, "a [\n\t1,\n\t2,\n\t3,\n\t4\n];\n"},
+		{[]interface{}{1, map[string]int{"b": 2}}, "a [\n\t1,\n\t{\n\t\tb 2\n\t}\n];\n"},
+		{[]int{}, "a [];\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetInlineArrayThreshold(3)
+		if err := e.Encode(map[string]interface{}{"a": test.v}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%v: got %q, expected %q", test.v, buf.String(), test.expect)
+		}
+	}
+}
+
+func TestEncodeMaxLineWidth(t *testing.T) {
+	type sub struct {
+		Names []string `json:"names"`
+	}
+	v := struct {
+		Ports []int `json:"ports"`
+		Sub   sub   `json:"sub"`
+		Long  []int `json:"long"`
+	}{[]int{8080, 8081, 8082, 8083}, sub{[]string{"alpha", "beta", "gamma"}}, []int{1, 2, 3, 4, 5, 6}}
+	long := "long [\n\t1,\n\t2,\n\t3,\n\t4,\n\t5,\n\t6\n];\n"
+	tests := []struct {
+		width  int
+		expect string
+	}{
+		{0, "ports [8080, 8081, 8082, 8083];\nsub {\n\tnames [alpha, beta, gamma];\n};\n" + long},
+		{31, "ports [8080, 8081, 8082, 8083];\nsub {\n\tnames [alpha, beta,\n\t\tgamma];\n};\n" + long},
+		{30, "ports [8080, 8081, 8082,\n\t8083];\nsub {\n\tnames [alpha, beta,\n\t\tgamma];\n};\n" + long},
+		{16, "ports [8080,\n\t8081,\n\t8082,\n\t8083];\nsub {\n\tnames [alpha,\n\t\tbeta,\n\t\tgamma];\n};\n" + long},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetInlineArrayThreshold(4)
+		e.SetMaxLineWidth(test.width)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("width %d: got %q, expected %q", test.width, buf.String(), test.expect)
+		}
+		again, err := NewDecoder(&buf).Decode()
+		if err != nil {
+			t.Fatalf("width %d: %v", test.width, err)
+		}
+		if len(again["ports"].([]interface{})) != 4 {
+			t.Errorf("width %d: decoded %v", test.width, again["ports"])
+		}
+	}
+}
+
+func TestEncodeEmptyCompound(t *testing.T) {
+	s := "a {}\nb { c {}; d []; e [ {}, 1 ] }\n"
+	ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(ucl); err != nil {
+		t.Fatal(err)
+	}
+	expect := "a {};\nb {\n\tc {};\n\td [];\n\te [\n\t\t{},\n\t\t1\n\t];\n};\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+
+	again, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, ucl) {
+		t.Errorf("round-trip: got %v, expected %v", again, ucl)
+	}
+
+	buf.Reset()
+	v := struct {
+		S struct{}        `json:"s"`
+		M map[string]bool `json:"m"`
+	}{M: map[string]bool{}}
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "s {};\nm {};\n" {
+		t.Errorf("struct: got %q", buf.String())
+	}
+
+	// a struct without fields to write is empty too
+	buf.Reset()
+	type hidden struct {
+		a    int
+		B    int      `json:"-"`
+		Keys []string `json:",keyorder"`
+	}
+	if err := NewEncoder(&buf).Encode(map[string]interface{}{
+		"h": hidden{a: 1, B: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "h {};\n" {
+		t.Errorf("hidden: got %q", buf.String())
+	}
+}
+
+func TestEncodeBoolStyle(t *testing.T) {
+	v := map[string]interface{}{
+		"a":      true,
+		"b":      false,
+		"list":   []interface{}{false, true},
+		KeyOrder: []string{"a", "b", "list"},
+	}
+	tests := []struct {
+		style  int
+		expect string
+	}{
+		{BoolTrueFalse, "a true;\nb false;\nlist [\n\tfalse,\n\ttrue\n];\n"},
+		{BoolYesNo, "a yes;\nb no;\nlist [\n\tno,\n\tyes\n];\n"},
+		{BoolOnOff, "a on;\nb off;\nlist [\n\toff,\n\ton\n];\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetBoolStyle(test.style)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("style %d: got %q, expected %q", test.style,
+				buf.String(), test.expect)
+		}
+
+		d := NewDecoder(&buf)
+		d.SetTypedValues(true)
+		again, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, v) {
+			t.Errorf("style %d: round-trip got %v", test.style, again)
+		}
+	}
+
+	// unknown styles are ignored
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetBoolStyle(BoolYesNo)
+	e.SetBoolStyle(-1)
+	e.SetBoolStyle(BoolOnOff + 1)
+	if err := e.Encode(map[string]bool{"a": true}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "a yes;\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestEncodeToString(t *testing.T) {
+	v := map[string]interface{}{"a": []int{1, 2}}
+	s, err := EncodeToString(v)
+	if err != nil || s != "a [\n\t1,\n\t2\n];\n" {
+		t.Errorf("got %q, %v", s, err)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetIndent("  ")
+	e.SetInlineArrayThreshold(2)
+	s, err = e.EncodeToString(v)
+	if err != nil || s != "a [1, 2];\n" {
+		t.Errorf("got %q, %v", s, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("writer got %q", buf.String())
+	}
+
+	s, err = EncodeToString(map[string]interface{}{"c": map[int]int{1: 2}})
+	if err == nil {
+		t.Errorf("expected error, got %q", s)
+	}
+}
+
+type testPeer struct {
+	Host string
+	Port int
+}
+
+func (p testPeer) MarshalUCL() ([]byte, error) {
+	return []byte(fmt.Sprintf("{\n\taddr \"%s:%d\";\n}", p.Host, p.Port)), nil
+}
+
+type testAddr struct {
+	testPeer
+}
+
+// a Marshaler of a kind other than struct
+type testPort int
+
+func (p testPort) MarshalUCL() ([]byte, error) {
+	return []byte(fmt.Sprintf("{\n\tport %d;\n}", p)), nil
+}
+
+func TestEncodeMarshaler(t *testing.T) {
+	type outer struct {
+		Name  string     `json:"name"`
+		Peer  testPeer   `json:"peer"`
+		Peers []testPeer `json:"peers"`
+	}
+	v := map[string]interface{}{
+		"outer": outer{"x", testPeer{"a", 1}, []testPeer{{"b", 2}}},
+	}
+	s, err := EncodeToString(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `outer {
+	name x;
+	peer {
+		addr "a:1";
+	};
+	peers [
+		{
+			addr "b:2";
+		}
+	];
+};
+`
+	if s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+	if _, err := NewDecoder(bytes.NewBufferString(s)).Decode(); err != nil {
+		t.Errorf("output does not decode: %v", err)
+	}
+
+	// promoted through embedding, the fields are not encoded
+	s, err = EncodeToString(map[string]interface{}{"a": testAddr{testPeer{"c", 3}}})
+	if err != nil || s != "a {\n\taddr \"c:3\";\n};\n" {
+		t.Errorf("embedded: got %q, %v", s, err)
+	}
+
+	// indented as struct Marshalers are, relative to the key
+	s, err = EncodeToString(map[string]interface{}{
+		"o": map[string]interface{}{"p": testPort(80)},
+		"l": []interface{}{testPort(81)},
+	})
+	if err != nil || !strings.Contains(s, "o {\n\tp {\n\t\tport 80;\n\t};\n};\n") ||
+		!strings.Contains(s, "l [\n\t{\n\t\tport 81;\n\t}\n];\n") {
+		t.Errorf("non-struct: got %q, %v", s, err)
+	}
+}
+
+func TestEncodeQuotePredicate(t *testing.T) {
+	v := map[string]interface{}{
+		"log_level":   "debug",
+		"server-name": "www.example.com",
+		"motd":        "hello world",
+		"empty":       "",
+		KeyOrder:      []string{"log_level", "server-name", "motd", "empty"},
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetQuotePredicate(func(s string) bool {
+		if s == "" {
+			return true
+		}
+		for _, c := range s {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+				c == '_' || c == '-' || c == '.') {
+				return true
+			}
+		}
+		return false
+	})
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect := "log_level debug;\nserver-name www.example.com;\nmotd \"hello world\";\nempty \"\";\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+
+	toks, err := Tokenize(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toks[2].Kind != SEMICOL || toks[3].Kind != TAG ||
+		string(toks[4].Value) != "www.example.com" {
+		t.Errorf("unexpected tokens %v", toks)
+	}
+	again, err := NewDecoder(&buf).Decode()
+	if err != nil || !reflect.DeepEqual(again, v) {
+		t.Errorf("round-trip: got %v, %v", again, err)
+	}
+
+	// the empty string is quoted whatever the predicate says
+	buf.Reset()
+	e.SetQuotePredicate(func(string) bool { return false })
+	if err := e.Encode(map[string]interface{}{"": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "\"\" \"\";\n"; buf.String() != expect {
+		t.Errorf("empty: got %q, expected %q", buf.String(), expect)
+	}
+}
+
+func TestEncodeValueFilter(t *testing.T) {
+	type db struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Debug    bool   `json:"debug"`
+	}
+	v := struct {
+		DB    db       `json:"db"`
+		Hosts []string `json:"hosts"`
+	}{db{"admin", "hunter2", true}, []string{"a", "secret", "c"}}
+
+	var paths []string
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetValueFilter(func(path string, v interface{}) (interface{}, bool) {
+		paths = append(paths, path)
+		switch {
+		case path == "db.password":
+			return "****", true
+		case path == "db.debug", v == "secret":
+			return nil, false
+		}
+		return v, true
+	})
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect := "db {\n\tuser admin;\n\tpassword \"****\";\n};\nhosts [\n\ta,\n\tc\n];\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+	expectpaths := []string{"db.user", "db.password", "db.debug",
+		"hosts.0", "hosts.1", "hosts.2"}
+	if !reflect.DeepEqual(paths, expectpaths) {
+		t.Errorf("got paths %v, expected %v", paths, expectpaths)
+	}
+
+	// inline arrays are filtered the same, and a nil element expands the
+	// array rather than leaving an empty slot
+	inline := map[string]interface{}{"a": []string{"x", "secret", "z"}}
+	tests := []struct {
+		secret interface{}
+		expect string
+	}{
+		{"****", "a [x, \"****\", z];\n"},
+		{nil, "a [\n\tx,\n\tnull,\n\tz\n];\n"},
+		{[]int{1, 2}, "a [\n\tx,\n\t[1, 2],\n\tz\n];\n"},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		e = NewEncoder(&buf)
+		e.SetInlineArrayThreshold(4)
+		e.SetValueFilter(func(path string, v interface{}) (interface{}, bool) {
+			if v == "secret" {
+				return test.secret, true
+			}
+			return v, true
+		})
+		if err := e.Encode(inline); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%v: got %q, expected %q", test.secret, buf.String(),
+				test.expect)
+		}
+		d := NewDecoder(&buf)
+		d.SetTypedValues(true)
+		if ucl, err := d.Decode(); err != nil || len(ucl["a"].([]interface{})) != 3 {
+			t.Errorf("%v: decoded %v, %v", test.secret, ucl, err)
+		}
+	}
+}
+
+func TestEncodeLazy(t *testing.T) {
+	calls := 0
+	v := map[string]interface{}{
+		"name": Lazy(func() (interface{}, error) {
+			calls++
+			return "web", nil
+		}),
+		"limits": Lazy(func() (interface{}, error) {
+			return map[string]interface{}{"cpu": 2}, nil
+		}),
+		"hosts": []interface{}{"a", Lazy(func() (interface{}, error) {
+			return "b", nil
+		})},
+		KeyOrder: []string{"name", "limits", "hosts"},
+	}
+	s, err := EncodeToString(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "name web;\nlimits {\n\tcpu 2;\n};\nhosts [\n\ta,\n\tb\n];\n"
+	if s != expect {
+		t.Errorf("got %q, expected %q", s, expect)
+	}
+	if calls != 1 {
+		t.Errorf("name computed %d times", calls)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err = e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect = "name: web\nlimits:\n  cpu: 2\nhosts:\n  - a\n  - b\n"
+	if buf.String() != expect {
+		t.Errorf("yaml: got %q, expected %q", buf.String(), expect)
+	}
+
+	failed := fmt.Errorf("no secret")
+	_, err = EncodeToString(map[string]interface{}{
+		"secret": Lazy(func() (interface{}, error) { return nil, failed }),
+	})
+	if err != failed {
+		t.Errorf("expected %v, got %v", failed, err)
+	}
+}
+
+func TestEncodeNumber(t *testing.T) {
+	v := map[string]interface{}{
+		"big":    Number("123456789012345678901234567890"),
+		"mem":    Number("10k"),
+		KeyOrder: []string{"big", "mem"},
+	}
+	s, err := EncodeToString(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "big 123456789012345678901234567890;\nmem 10k;\n"
+	if s != expect {
+		t.Errorf("got %q, expected %q", s, expect)
+	}
+}
+
+func TestEncodeBigNumbers(t *testing.T) {
+	type nums struct {
+		Int   *big.Int   `json:"int"`
+		Neg   big.Int    `json:"neg"`
+		Float *big.Float `json:"float"`
+		Rat   *big.Rat   `json:"rat"`
+		Whole *big.Rat   `json:"whole"`
+		Inf   *big.Float `json:"inf"`
+		List  []*big.Int `json:"list"`
+	}
+	i, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	f, _ := new(big.Float).SetPrec(200).SetString("1.000000000000000000000000001e+40")
+	v := nums{
+		Int:   i,
+		Neg:   *new(big.Int).Neg(i),
+		Float: f,
+		Rat:   big.NewRat(1, 3),
+		Whole: big.NewRat(10, 2),
+		Inf:   new(big.Float).SetInf(false),
+		List:  []*big.Int{big.NewInt(1), i},
+	}
+
+	s, err := EncodeToString(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "int 123456789012345678901234567890;\n" +
+		"neg -123456789012345678901234567890;\n" +
+		"float 1.000000000000000000000000001e+40;\n" +
+		"rat \"1/3\";\n" +
+		"whole 5;\n" +
+		"inf \"+Inf\";\n" +
+		"list [\n\t1,\n\t123456789012345678901234567890\n];\n"
+	if s != expect {
+		t.Errorf("got %q, expected %q", s, expect)
+	}
+
+	var again nums
+	if err = Unmarshal([]byte(s), &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.Int.Cmp(v.Int) != 0 || again.Neg.Cmp(&v.Neg) != 0 ||
+		again.Float.Cmp(v.Float) != 0 || again.Rat.Cmp(v.Rat) != 0 ||
+		again.Whole.Cmp(v.Whole) != 0 || !again.Inf.IsInf() ||
+		len(again.List) != 2 || again.List[1].Cmp(i) != 0 {
+		t.Errorf("round-trip: got %+v", again)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err = e.Encode(map[string]interface{}{"n": i, "l": []*big.Int{i}}); err != nil {
+		t.Fatal(err)
+	}
+	expect = "l:\n  - 123456789012345678901234567890\n\"n\": 123456789012345678901234567890\n"
+	if buf.String() != expect {
+		t.Errorf("yaml: got %q, expected %q", buf.String(), expect)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"a=1;b   :   \"two words\"\n  c{d=[1,2,3];e {f g}}",
+			"a 1;\nb \"two words\";\nc {\n  d [\n    1,\n    2,\n    3\n  ];\n  e {\n    f g;\n  };\n};\n"},
+		{"a=1;\nc{d=[1,2,3];e {f g}}",
+			"a 1;\nc {\n\td [\n\t\t1,\n\t\t2,\n\t\t3\n\t];\n\te {\n\t\tf g;\n\t};\n};\n"},
+		{"# comment\nkey \"value\" ; /* c */ other 'x y'\n",
+			"key value;\nother \"x y\";\n"},
+		{"re /^a.*$/;\nempty {}\nlist [];\nnull;\n",
+			"re /^a.*$/;\nempty {};\nlist [];\nnull;\n"},
+		{"h <<EOD\nline one\nline two\nEOD\nk v",
+			"h \"line one\\nline two\";\nk v;\n"},
+		{"dup 1; dup 2;\n", "dup [\n\t1,\n\t2\n];\n"},
+		{"q \"tab\\there\";\nu \"\";\n", "q \"tab\\there\";\nu \"\";\n"},
+		{"\"\" 1;\nb 2;\n", "\"\" 1;\nb 2;\n"},
+		{"a { \"\" x; }", "a {\n\t\"\" x;\n};\n"},
+	}
+	for _, test := range tests {
+		out, err := Format([]byte(test.in))
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if string(out) != test.expect {
+			t.Errorf("%q: got %q, expected %q", test.in, out, test.expect)
+			continue
+		}
+		again, err := Format(out)
+		if err != nil || string(again) != string(out) {
+			t.Errorf("%q: formatting again gave %q, %v", test.in, again, err)
+		}
+	}
+
+	if _, err := Format([]byte("a { b 1;\n")); err == nil {
+		t.Error("expected error for unclosed brace")
+	}
+
+	// the style of the source is kept
+	in := "a {\r\n    b 1;\r\n    c [x, y];\r\n}\r\n"
+	out, err := Format([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a {\r\n    b 1;\r\n    c [\r\n        x,\r\n        y\r\n    ];\r\n};\r\n" {
+		t.Errorf("crlf: got %q", out)
+	}
+}
+
+func TestEncodeTrailingNewline(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		with    string
+		without string
+	}{
+		{map[string]interface{}{"a": 1}, "a 1;\n", "a 1;"},
+		{[]int{1, 2}, "[\n\t1,\n\t2\n]\n", "[\n\t1,\n\t2\n]"},
+		{[]int{}, "[]\n", "[]"},
+		{"x", "x\n", "x"},
+		{"two\n", "\"two\\n\"\n", "\"two\\n\""},
+		{map[string]interface{}{}, "", ""},
+	}
+	for _, test := range tests {
+		for _, on := range []bool{true, false} {
+			var buf bytes.Buffer
+			e := NewEncoder(&buf)
+			e.SetTrailingNewline(on)
+			if err := e.Encode(test.v); err != nil {
+				t.Fatal(err)
+			}
+			expect := test.without
+			if on {
+				expect = test.with
+			}
+			if buf.String() != expect {
+				t.Errorf("%v, %t: got %q, expected %q", test.v, on,
+					buf.String(), expect)
+			}
+		}
+	}
+}
+
+func TestEncodeNestedSlices(t *testing.T) {
+	tests := []struct {
+		v      interface{}
+		inline int
+		expect string
+	}{
+		{map[string]interface{}{"m": [][]int{{1, 2}, {3}}}, 0,
+			"m [\n\t[\n\t\t1,\n\t\t2\n\t],\n\t[\n\t\t3\n\t]\n];\n"},
+		{map[string]interface{}{"m": [][]int{{1, 2}, {3}}}, 4,
+			"m [\n\t[1, 2],\n\t[3]\n];\n"},
+		{map[string]interface{}{"m": [][]string{{"a"}, {}, {"b", "c"}}}, 0,
+			"m [\n\t[\n\t\ta\n\t],\n\t[],\n\t[\n\t\tb,\n\t\tc\n\t]\n];\n"},
+		{map[string]interface{}{"m": [][]map[string]int{{{"x": 1}}, {{"y": 2}}}}, 0,
+			"m [\n\t[\n\t\t{\n\t\t\tx 1\n\t\t}\n\t],\n\t[\n\t\t{\n\t\t\ty 2\n\t\t}\n\t]\n];\n"},
+		{map[string]interface{}{"o": map[string]interface{}{"m": [][][]int{{{1}, {2, 3}}}}}, 0,
+			"o {\n\tm [\n\t\t[\n\t\t\t[\n\t\t\t\t1\n\t\t\t],\n\t\t\t[\n\t\t\t\t2,\n\t\t\t\t3\n\t\t\t]\n\t\t]\n\t];\n};\n"},
+		{[][]int{{1}, {2}}, 0, "[\n\t[\n\t\t1\n\t],\n\t[\n\t\t2\n\t]\n]"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetInlineArrayThreshold(test.inline)
+		if err := e.Encode(test.v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%v: got %q, expected %q", test.v, buf.String(), test.expect)
+			continue
+		}
+		if _, ok := test.v.(map[string]interface{}); !ok {
+			continue
+		}
+		if _, err := NewDecoder(&buf).Decode(); err != nil {
+			t.Errorf("%v: decoding output: %v", test.v, err)
+		}
+	}
+}
+
+type omitBase struct {
+	ID   int    `json:"id"`
+	Note string `json:"note"`
+}
+
+func TestEncodeOmitZeroValues(t *testing.T) {
+	n := 0
+	type conf struct {
+		omitBase
+		Name  string            `json:"name"`
+		Port  int               `json:"port"`
+		Ptr   *int              `json:"ptr"`
+		Tags  []string          `json:"tags"`
+		Opts  map[string]string `json:"opts"`
+		Inner struct {
+			On bool `json:"on"`
+		} `json:"inner"`
+		Last string `json:"last"`
+	}
+	tests := []struct {
+		v      conf
+		expect string
+	}{
+		{conf{}, ""},
+		{conf{Name: "x", Last: "y"}, "name x;\nlast y;\n"},
+		{conf{omitBase: omitBase{ID: 3}, Port: 80}, "id 3;\nport 80;\n"},
+		{conf{Ptr: &n, Opts: map[string]string{}}, "ptr 0;\nopts {};\n"},
+		{conf{Last: "z", Inner: struct {
+			On bool `json:"on"`
+		}{true}}, "inner {\n\ton true;\n};\nlast z;\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetOmitZeroValues(true)
+		if err := e.Encode(test.v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%+v: got %q, expected %q", test.v, buf.String(), test.expect)
+		}
+	}
+
+	// a struct with only zero fields is written on one line
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetOmitZeroValues(true)
+	if err := e.Encode(map[string]interface{}{"z": conf{}}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "z {};\n" {
+		t.Errorf("zero struct: got %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := NewEncoder(&buf).Encode(conf{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "port 0;") {
+		t.Errorf("zero values dropped by default: %q", buf.String())
+	}
+}
+
+func TestEncodeArrayObjectStyle(t *testing.T) {
+	type item struct {
+		A int    `json:"a"`
+		B string `json:"b"`
+	}
+	v := struct {
+		M []interface{} `json:"m"`
+		S []item        `json:"s"`
+	}{
+		M: []interface{}{
+			map[string]interface{}{"x": "a b"},
+			map[string]interface{}{"z": map[string]int{"q": 1}},
+		},
+		S: []item{{1, "x"}, {2, "y"}},
+	}
+	tests := []struct {
+		style  int
+		indent string
+		expect string
+	}{
+		{ArrayObjectBraces, "\t",
+			"m [\n\t{\n\t\tx \"a b\"\n\t},\n\t{\n\t\tz {\n\t\t\tq 1;\n\t\t}\n\t}\n];\n" +
+				"s [\n\t{\n\t\ta 1;\n\t\tb x;\n\t},\n\t{\n\t\ta 2;\n\t\tb y;\n\t}\n];\n"},
+		{ArrayObjectTerminated, "\t",
+			"m [\n\t{\n\t\tx \"a b\";\n\t},\n\t{\n\t\tz {\n\t\t\tq 1;\n\t\t};\n\t}\n];\n" +
+				"s [\n\t{\n\t\ta 1;\n\t\tb x;\n\t},\n\t{\n\t\ta 2;\n\t\tb y;\n\t}\n];\n"},
+		{ArrayObjectTerminated, "",
+			"m [{x \"a b\";},{z {q 1;};}];s [{a 1;b x;},{a 2;b y;}];"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetIndent(test.indent)
+		e.SetArrayObjectStyle(test.style)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("style %d: got %q, expected %q", test.style, buf.String(),
+				test.expect)
+			continue
+		}
+		ucl, err := NewDecoder(&buf).Decode()
+		if err != nil {
+			t.Errorf("style %d: decoding output: %v", test.style, err)
+			continue
+		}
+		if m, ok := ucl["m"].([]interface{}); !ok || len(m) != 2 {
+			t.Errorf("style %d: got %v", test.style, ucl)
+		}
+	}
+}
+
+func TestEncodeOrderedMap(t *testing.T) {
+	inner := NewOrderedMap()
+	inner.Set("y", 2)
+	inner.Set("a", []interface{}{"x"})
+	m := NewOrderedMap()
+	m.Set("z", 1)
+	m.Set("b", inner)
+	m.Set("e", &OrderedMap{})
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	expect := "z 1;\nb {\n\ty 2;\n\ta [\n\t\tx\n\t];\n};\ne {};\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+
+	d := NewDecoder(&buf)
+	back, err := d.DecodeOrdered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Keys(), []string{"z", "b", "e"}) {
+		t.Errorf("round-trip: got keys %v", back.Keys())
+	}
+
+	buf.Reset()
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err := e.Encode(map[string]interface{}{"o": inner}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "o:\n  \"y\": 2\n  a:\n") {
+		t.Errorf("yaml: got %q", buf.String())
+	}
+}
+
+func TestEncodeRegex(t *testing.T) {
+	patterns := []Regex{`^a b\d+$`, `x/y`, `\\/`, `[/ ]\s`, ``,
+		`(a|b){2,}#"'`, `x;y,z`, `^\[\]$`}
+	for _, p := range patterns {
+		v := map[string]interface{}{"re": p, "list": []interface{}{p, p}}
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		d := NewDecoder(&buf)
+		d.SetTypedValues(true)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Errorf("%q: decoding %q: %v", p, out, err)
+			continue
+		}
+		if ucl["re"] != p {
+			t.Errorf("%q: got %#v from %q", p, ucl["re"], out)
+		}
+		list, _ := ucl["list"].([]interface{})
+		if len(list) != 2 || list[0] != p || list[1] != p {
+			t.Errorf("%q: got list %#v from %q", p, ucl["list"], out)
+		}
+	}
+
+	s, err := EncodeToString(map[string]interface{}{"re": Regex("a b/c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "re /a\\ b\\/c/;\n" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestEncodeArray(t *testing.T) {
+	items := []interface{}{1, "two words", map[string]interface{}{"a": 1},
+		[]int{2, 3}, nil}
+	produce := func(yield func(interface{}) error) error {
+		ch := make(chan interface{})
+		go func() {
+			for _, item := range items {
+				ch <- item
+			}
+			close(ch)
+		}()
+		for item := range ch {
+			if err := yield(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, format := range []int{FormatUCL, FormatYAML} {
+		for _, nl := range []bool{false, true} {
+			var got, expect bytes.Buffer
+			e := NewEncoder(&got)
+			e.SetFormat(format)
+			e.SetTrailingNewline(nl)
+			if err := e.EncodeArray(produce); err != nil {
+				t.Fatal(err)
+			}
+			ee := NewEncoder(&expect)
+			ee.SetFormat(format)
+			ee.SetTrailingNewline(nl)
+			if err := ee.Encode(items); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != expect.String() {
+				t.Errorf("format %d, newline %v: got %q, expected %q",
+					format, nl, got.String(), expect.String())
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).EncodeArray(func(yield func(interface{}) error) error {
+		return nil
+	})
+	if err != nil || buf.String() != "[]" {
+		t.Errorf("empty: got %q, %v", buf.String(), err)
+	}
+
+	fail := fmt.Errorf("producer failed")
+	err = NewEncoder(&buf).EncodeArray(func(yield func(interface{}) error) error {
+		yield(1)
+		return fail
+	})
+	if err != fail {
+		t.Errorf("got error %v, expected %v", err, fail)
+	}
+}
+
+func TestEncodeNilCompoundPointers(t *testing.T) {
+	type ptrs struct {
+		NilMap    *map[string]int
+		EmptyMap  *map[string]int
+		NilList   *[]int
+		EmptyList *[]int
+	}
+	em, el := map[string]int{}, []int{}
+	v := ptrs{EmptyMap: &em, EmptyList: &el}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect := "NilMap;\nEmptyMap {};\nNilList;\nEmptyList [];\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+	ucl, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"NilMap":    nil,
+		"EmptyMap":  map[string]interface{}{},
+		"NilList":   nil,
+		"EmptyList": []interface{}{},
+	} {
+		if got, ok := ucl[k]; !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, expected %#v", k, got, want)
+		}
+	}
+
+	// the same held in interfaces, as in a decoded document
+	buf.Reset()
+	m := map[string]interface{}{
+		KeyOrder:    []string{"nilmap", "emptymap", "nillist", "emptylist"},
+		"nilmap":    (*map[string]int)(nil),
+		"emptymap":  &em,
+		"nillist":   (*[]int)(nil),
+		"emptylist": &el,
+	}
+	if err := NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	expect = "nilmap;\nemptymap {};\nnillist;\nemptylist [];\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+
+	buf.Reset()
+	e := NewEncoder(&buf)
+	e.SetFormat(FormatYAML)
+	if err := e.Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	expect = "nilmap: null\nemptymap: {}\nnillist: null\nemptylist: []\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+}
+
+func TestEncodeNilMode(t *testing.T) {
+	type nils struct {
+		A *int          `json:"a"`
+		B interface{}   `json:"b"`
+		L []interface{} `json:"l"`
+	}
+	v := nils{L: []interface{}{nil, 1}}
+	tests := []struct {
+		mode   int
+		nilval string
+		expect string
+	}{
+		{NilVerbatim, "", "a;\nb;\nl [\n\tnull,\n\t1\n];\n"},
+		{NilVerbatim, "nil", "a nil;\nb nil;\nl [\n\tnil,\n\t1\n];\n"},
+		{NilOmitKey, "", "l [\n\tnull,\n\t1\n];\n"},
+		{NilBareword, "", "a null;\nb null;\nl [\n\tnull,\n\t1\n];\n"},
+		{NilBareword, "nil", "a nil;\nb nil;\nl [\n\tnil,\n\t1\n];\n"},
+		{NilBareword, "n/a x", "a \"n/a x\";\nb \"n/a x\";\nl [\n\t\"n/a x\",\n\t1\n];\n"},
+		{NilQuoted, "none", "a \"none\";\nb \"none\";\nl [\n\t\"none\",\n\t1\n];\n"},
+		{NilQuoted, "", "a null;\nb null;\nl [\n\tnull,\n\t1\n];\n"},
+		{NilNull, "nil", "a null;\nb null;\nl [\n\tnull,\n\t1\n];\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetNilMode(test.mode)
+		e.SetNilValue(test.nilval)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("mode %d, %q: got %q, expected %q", test.mode,
+				test.nilval, buf.String(), test.expect)
+			continue
+		}
+
+		// all but quoted strings read back as nil
+		if strings.Contains(test.expect, `"`) {
+			continue
+		}
+		d := NewDecoder(&buf)
+		d.SetTypedValues(true)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ucl["a"] != nil || ucl["b"] != nil {
+			t.Errorf("mode %d: decoded %v", test.mode, ucl)
+		}
+		if l, _ := ucl["l"].([]interface{}); len(l) != 2 || l[0] != nil {
+			t.Errorf("mode %d: decoded list %v", test.mode, ucl["l"])
+		}
+	}
+}
+
+func TestEncodeMapNilEntries(t *testing.T) {
+	m := map[string]interface{}{
+		KeyOrder: []string{"a", "b", "c", "gone", "d", "l"},
+		"a":      nil,
+		"b":      (*int)(nil),
+		"c":      1,
+		"d":      map[string]interface{}{"x": nil},
+		"l":      []interface{}{nil, "v"},
+	}
+	tests := []struct {
+		mode   int
+		format int
+		expect string
+	}{
+		{NilVerbatim, FormatUCL,
+			"a;\nb;\nc 1;\nd {\n\tx;\n};\nl [\n\tnull,\n\tv\n];\n"},
+		{NilOmitKey, FormatUCL, "c 1;\nd {};\nl [\n\tnull,\n\tv\n];\n"},
+		{NilBareword, FormatUCL,
+			"a null;\nb null;\nc 1;\nd {\n\tx null;\n};\nl [\n\tnull,\n\tv\n];\n"},
+		{NilOmitKey, FormatYAML, "c: 1\nd: {}\nl:\n  - null\n  - v\n"},
+		{NilVerbatim, FormatYAML,
+			"a: null\nb: null\nc: 1\nd:\n  x: null\nl:\n  - null\n  - v\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetFormat(test.format)
+		e.SetNilMode(test.mode)
+		if err := e.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("mode %d, format %d: got %q, expected %q", test.mode,
+				test.format, buf.String(), test.expect)
+		}
+	}
+
+	// without a KeyOrder every key is written, nil or not
+	delete(m, KeyOrder)
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"a;\n", "b;\n", "c 1;\n", "\tx;\n"} {
+		if !strings.Contains(buf.String(), l) {
+			t.Errorf("%q missing from %q", l, buf.String())
+		}
+	}
+}
+
+func TestEncodeTimeFormat(t *testing.T) {
+	type event struct {
+		At   time.Time   `json:"at"`
+		Seen []time.Time `json:"seen"`
+	}
+	at := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	v := event{at, []time.Time{at.Add(time.Hour)}}
+	tests := []struct {
+		layout string
+		expect string
+		yaml   string
+	}{
+		{"", "at \"2024-03-05T14:30:00Z\";\nseen [\"2024-03-05T15:30:00Z\"];\n",
+			"at: 2024-03-05T14:30:00Z\nseen:\n  - 2024-03-05T15:30:00Z\n"},
+		{time.RFC1123, "at \"Tue, 05 Mar 2024 14:30:00 UTC\";\n" +
+			"seen [\"Tue, 05 Mar 2024 15:30:00 UTC\"];\n",
+			"at: Tue, 05 Mar 2024 14:30:00 UTC\nseen:\n  - Tue, 05 Mar 2024 15:30:00 UTC\n"},
+		{"2006-01-02", "at \"2024-03-05\";\nseen [\"2024-03-05\"];\n",
+			"at: 2024-03-05\nseen:\n  - 2024-03-05\n"},
+		{UnixTime, "at 1709649000;\nseen [1709652600];\n",
+			"at: 1709649000\nseen:\n  - 1709652600\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetInlineArrayThreshold(2)
+		e.SetTimeFormat(test.layout)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%q: got %q, expected %q", test.layout, buf.String(), test.expect)
+		}
+
+		var back event
+		d := NewDecoder(&buf)
+		if test.layout != "" {
+			d.SetTimeLayouts([]string{test.layout})
+		}
+		if err := d.Unmarshal(&back); err != nil {
+			t.Fatalf("%q: %v", test.layout, err)
+		}
+		want := at
+		if test.layout == "2006-01-02" {
+			want = time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+		}
+		if !back.At.Equal(want) || len(back.Seen) != 1 {
+			t.Errorf("%q: decoded %v, expected %v", test.layout, back, want)
+		}
+
+		buf.Reset()
+		e.SetFormat(FormatYAML)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.yaml {
+			t.Errorf("%q: got YAML %q, expected %q", test.layout, buf.String(), test.yaml)
+		}
+	}
+
+	var back event
+	d := NewDecoder(bytes.NewBufferString("at 1709649000;\n"))
+	d.SetTimeLayouts([]string{time.RFC3339, UnixTime})
+	if err := d.Unmarshal(&back); err != nil || !back.At.Equal(at) {
+		t.Errorf("got %v, %v", back.At, err)
+	}
+	if err := Unmarshal([]byte("at yesterday;\n"), &back); err == nil {
+		t.Error("expected an error for an unparsable time")
+	}
+}
+
+func TestEncodeKeyOrderField(t *testing.T) {
+	type config struct {
+		Order []string `json:",keyorder"`
+		Name  string   `json:"name"`
+		Port  int      `json:"port"`
+		Debug bool     `json:"debug"`
+	}
+	var cfg config
+	if err := Unmarshal([]byte("port 80;\ndebug true;\nname web;\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Order, []string{"port", "debug", "name"}) {
+		t.Fatalf("got order %v", cfg.Order)
+	}
+
+	tests := []struct {
+		order  []string
+		format int
+		expect string
+	}{
+		{cfg.Order, FormatUCL, "port 80;\ndebug true;\nname web;\n"},
+		{cfg.Order, FormatYAML, "port: 80\ndebug: true\nname: web\n"},
+		{[]string{"gone", "debug"}, FormatUCL, "debug true;\nname web;\nport 80;\n"},
+		{nil, FormatUCL, "name web;\nport 80;\ndebug true;\n"},
+	}
+	for _, test := range tests {
+		cfg.Order = test.order
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetFormat(test.format)
+		if err := e.Encode(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("%v: got %q, expected %q", test.order, buf.String(), test.expect)
+		}
+	}
+}
+
+func TestEncodeHeredocDelimiter(t *testing.T) {
+	v := map[string]interface{}{"s": "EOSTR\n\\EOSTR\nEOSTR;x\nEOSTRX\n EOSTR"}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMultilineThreshold(1)
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect := "s <<EOSTR\n\\EOSTR\n\\\\EOSTR\n\\EOSTR;x\nEOSTRX\n EOSTR\nEOSTR;\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+	again, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again["s"] != v["s"] {
+		t.Errorf("decoded %q, expected %q", again["s"], v["s"])
+	}
+}
+
+func TestEncodeHeredocTag(t *testing.T) {
+	v := map[string]interface{}{"s": "a\nEOSTR\nEOT"}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMultilineThreshold(1)
+	e.SetHeredocTag("EOT")
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expect := "s <<EOT\na\nEOSTR\n\\EOT\nEOT;\n"
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf.String(), expect)
+	}
+	again, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again["s"] != v["s"] {
+		t.Errorf("decoded %q, expected %q", again["s"], v["s"])
+	}
+
+	// an empty tag is the default
+	buf.Reset()
+	e.SetHeredocTag("")
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "s <<"+DefaultHeredocTag+"\n") {
+		t.Errorf("got %q", buf.String())
+	}
+
+	for _, tag := range []string{"END-OF", "<<EOD", "É"} {
+		e.SetHeredocTag(tag)
+		if err := e.Encode(v); err == nil {
+			t.Errorf("%q: expected error", tag)
+		}
+	}
+	// tags only matter for heredocs
+	e.SetMultilineThreshold(0)
+	if err := e.Encode(map[string]string{"k": "v"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Comparison of decoded UCL objects
+ */
+package ucl
+
+import "reflect"
+
+// Equal reports whether the decoded objects a and b hold the same keys with
+// equal values, ignoring KeyOrder entries and so the order of keys.
+// Objects within them may be maps or *OrderedMap. Scalars are compared
+// with reflect.DeepEqual, so the string "80" differs from int64(80); see
+// EqualValues.
+func Equal(a, b map[string]interface{}) bool {
+	return equal(a, b, false)
+}
+
+// EqualValues is like Equal but compares scalars by what they denote:
+// strings and Numbers are typed as by SetTypedValues, and numbers of any Go
+// type compare by value. So "80", Number("80"), int64(80), 80 and 80.0 are
+// equal, as are "yes" and true, and "1k" and 1000.
+func EqualValues(a, b map[string]interface{}) bool {
+	return equal(a, b, true)
+}
+
+func equal(a, b interface{}, norm bool) bool {
+	if m, ok := a.(*OrderedMap); ok && m != nil {
+		a = m.keymap()
+	}
+	if m, ok := b.(*OrderedMap); ok && m != nil {
+		b = m.keymap()
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || objlen(av) != objlen(bv) {
+			return false
+		}
+		for k, v := range av {
+			if k == KeyOrder {
+				continue
+			}
+			if w, ok := bv[k]; !ok || !equal(v, w, norm) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i], norm) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !norm {
+		return reflect.DeepEqual(a, b)
+	}
+	a, b = normscalar(a), normscalar(b)
+	if af, ok := a.(float64); ok {
+		if bi, ok := b.(int64); ok {
+			return af == float64(bi)
+		}
+	}
+	if ai, ok := a.(int64); ok {
+		if bf, ok := b.(float64); ok {
+			return float64(ai) == bf
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// objlen returns the number of keys of m other than KeyOrder
+func objlen(m map[string]interface{}) int {
+	if _, ok := m[KeyOrder]; ok {
+		return len(m) - 1
+	}
+	return len(m)
+}
+
+// normscalar converts a scalar for EqualValues: strings and Numbers to
+// their typed values, integers to int64 and floats to float64
+func normscalar(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case string:
+		if r, ok := toregex(vv); ok {
+			return r
+		}
+		return typedvalue(vv)
+	case Number:
+		return typedvalue(string(vv))
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u <= 1<<63-1 {
+			return int64(u)
+		}
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String:
+		return normscalar(rv.String())
+	}
+	return v
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+/*
+ * Stylistic checks of UCL sources
+ */
+package ucl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A LintIssue is a stylistic problem found by Lint at a line and column of
+// the source, both counted from 1.
+type LintIssue struct {
+	Line    int
+	Col     int
+	Message string
+}
+
+func (li LintIssue) String() string {
+	return fmt.Sprintf("line %d, column %d: %s", li.Line, li.Col, li.Message)
+}
+
+// Lint reports stylistic issues in src that the decoder accepts: lines
+// indented with both tabs and spaces or unlike the first indented line,
+// trailing whitespace, a missing newline at the end, quoted keys that need
+// no quotes and unquoted keys with characters other than letters, digits,
+// '_', '-' and '.'. Multi-line strings are left alone. The issues are
+// sorted by position; an error is returned if src cannot be scanned.
+func Lint(src []byte) ([]LintIssue, error) {
+	toks, err := Tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []LintIssue
+	report := func(line, col int, format string, a ...interface{}) {
+		issues = append(issues, LintIssue{line, col, fmt.Sprintf(format, a...)})
+	}
+
+	inside, opening := continued(src, toks)
+	var depth []TokenKind
+	expectkey := true
+	for _, t := range toks {
+		switch t.Kind {
+		case TAG, QUOTE, VQUOTE:
+			if !expectkey {
+				break
+			}
+			expectkey = false
+			if t.Kind != TAG && plainkey(t.Value) {
+				report(t.Line, t.Col, "key %q need not be quoted", t.Value)
+			} else if t.Kind == TAG && !plainkey(t.Value) {
+				report(t.Line, t.Col, "key %q should be quoted", t.Value)
+			}
+		case BRACEOPEN, BRACKETOPEN:
+			depth = append(depth, t.Kind)
+		case BRACECLOSE, BRACKETCLOSE:
+			if len(depth) > 0 {
+				depth = depth[:len(depth)-1]
+			}
+		case HCOMMENT, LCOMMENT:
+			continue
+		}
+		switch t.Kind {
+		case SEMICOL, COMMA, BRACEOPEN, BRACECLOSE, BRACKETCLOSE, MLSTRING:
+			expectkey = len(depth) == 0 || depth[len(depth)-1] == BRACEOPEN
+		case BRACKETOPEN:
+			expectkey = false
+		}
+	}
+
+	var indent byte
+	lines := bytes.Split(src, []byte("\n"))
+	for i, l := range lines {
+		line := i + 1
+		if inside[line] || i == len(lines)-1 && len(l) == 0 {
+			continue
+		}
+		l = bytes.TrimSuffix(l, []byte("\r"))
+
+		ws := len(l) - len(bytes.TrimLeft(l, " \t"))
+		if ws < len(l) && ws > 0 {
+			lead := l[:ws]
+			if indent == 0 {
+				indent = lead[0]
+			}
+			if bytes.IndexByte(lead, ' ') >= 0 && bytes.IndexByte(lead, '\t') >= 0 {
+				report(line, 1, "indentation mixes tabs and spaces")
+			} else if lead[0] != indent {
+				report(line, 1, "indented with %s, unlike line %d",
+					indentname(lead[0]), firstindented(lines, inside))
+			}
+		}
+
+		if trimmed := bytes.TrimRight(l, " \t"); len(trimmed) < len(l) &&
+			!opening[line] {
+			report(line, len(trimmed)+1, "trailing whitespace")
+		}
+	}
+
+	if n := len(src); n > 0 && src[n-1] != '\n' {
+		last := lines[len(lines)-1]
+		report(len(lines), len(last)+1, "missing newline at end of file")
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Line != issues[j].Line {
+			return issues[i].Line < issues[j].Line
+		}
+		return issues[i].Col < issues[j].Col
+	})
+	return issues, nil
+}
+
+// continued returns the lines continuing the multi-line strings and
+// comments among toks, the tokens of src, and those on which they start,
+// where trailing whitespace may be part of the string
+func continued(src []byte, toks []Token) (inside, opening map[int]bool) {
+	inside = make(map[int]bool)
+	opening = make(map[int]bool)
+	for ti, t := range toks {
+		n := 0
+		switch {
+		case t.Kind == MLSTRING:
+			n = bytes.Count(t.Value, []byte("\n")) + 1
+		case t.Col == 0 && ti+1 < len(toks):
+			// quoted values are unescaped, so look where the next
+			// token is
+			n = toks[ti+1].Line - t.Line
+		case t.Col == 0:
+			n = bytes.Count(src, []byte("\n")) + 1 - t.Line
+		}
+		if n > 0 && t.Kind != MLSTRING {
+			opening[t.Line] = true
+		}
+		for i := 1; i <= n; i++ {
+			inside[t.Line+i] = true
+		}
+	}
+	return inside, opening
+}
+
+// DetectStyle returns the indentation unit and line separator of the UCL
+// document src, which Format keeps. The indentation is a tab if at least
+// as many lines are indented with tabs as with spaces, and otherwise as
+// many spaces as the least indented line has; without indented lines it
+// is DefaultIndent. The line separator is "\r\n" if most lines end with
+// it, and otherwise DefaultLineSeparator. Lines within multi-line strings
+// and comments are not considered.
+func DetectStyle(src []byte) (indent string, lineSep string) {
+	lineSep = DefaultLineSeparator
+	crlf := bytes.Count(src, []byte("\r\n"))
+	if 2*crlf > bytes.Count(src, []byte("\n")) {
+		lineSep = "\r\n"
+	}
+
+	var inside map[int]bool
+	if toks, err := Tokenize(src); err == nil {
+		inside, _ = continued(src, toks)
+	}
+	tabs, spaces, width := 0, 0, 0
+	for i, l := range bytes.Split(src, []byte("\n")) {
+		l = bytes.TrimRight(l, " \t\r")
+		ws := len(l) - len(bytes.TrimLeft(l, " \t"))
+		if inside[i+1] || ws == 0 || ws == len(l) {
+			continue
+		}
+		if l[0] == '\t' {
+			tabs++
+			continue
+		}
+		spaces++
+		if n := len(l) - len(bytes.TrimLeft(l, " ")); width == 0 || n < width {
+			width = n
+		}
+	}
+
+	switch {
+	case tabs == 0 && spaces == 0:
+		indent = DefaultIndent
+	case tabs >= spaces:
+		indent = "\t"
+	default:
+		indent = strings.Repeat(" ", width)
+	}
+	return indent, lineSep
+}
+
+// plainkey reports whether key reads the same with or without quotes
+func plainkey(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' ||
+			c >= 0x80) {
+			return false
+		}
+	}
+	return true
+}
+
+// firstindented returns the number of the first indented line outside
+// multi-line strings and comments
+func firstindented(lines [][]byte, inside map[int]bool) int {
+	for i, l := range lines {
+		if !inside[i+1] && len(l) > 0 && (l[0] == ' ' || l[0] == '\t') &&
+			len(bytes.TrimSpace(l)) > 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func indentname(c byte) string {
+	if c == '\t' {
+		return "tabs"
+	}
+	return "spaces"
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Merging of decoded UCL objects
+ */
+package ucl
+
+import "fmt"
+
+// A MergeMode selects how Merge combines values found under the same key.
+// Objects are always merged key by key.
+type MergeMode int
+
+const (
+	MergeAppend  MergeMode = iota // arrays are appended to, scalars replaced
+	MergeReplace                  // arrays and scalars are replaced
+	MergeKeep                     // values already in dst are kept
+)
+
+// Merge merges the decoded object src into dst, as when layering an
+// environment's configuration over a base one. Keys only in src are added
+// to dst after its own keys, in src's order, extending dst's KeyOrder.
+// Values taken from src are copied, so dst never shares maps or arrays
+// with it.
+//
+// In MergeAppend mode, the UCL rules, an array in dst gets the elements of
+// an array in src, or a scalar, appended; other values of src replace those
+// of dst.
+func Merge(dst, src map[string]interface{}, mode MergeMode) error {
+	if dst == nil {
+		return fmt.Errorf("Merge into nil map")
+	}
+	switch mode {
+	case MergeAppend, MergeReplace, MergeKeep:
+	default:
+		return fmt.Errorf("unknown merge mode %d", mode)
+	}
+	merge(dst, src, mode)
+	return nil
+}
+
+func merge(dst, src map[string]interface{}, mode MergeMode) {
+	korder, ordered := dst[KeyOrder].([]string)
+	if _, ok := src[KeyOrder]; ok && !ordered {
+		korder, ordered = objkeys(dst), true
+	}
+
+	for _, k := range objkeys(src) {
+		sv := src[k]
+		dv, ok := dst[k]
+		if !ok {
+			dst[k] = copyvalue(sv)
+			if ordered {
+				korder = append(korder, k)
+			}
+			continue
+		}
+
+		dm, dok := dv.(map[string]interface{})
+		sm, sok := sv.(map[string]interface{})
+		if dok && sok {
+			merge(dm, sm, mode)
+			continue
+		}
+		switch mode {
+		case MergeAppend:
+			if list, ok := dv.([]interface{}); ok {
+				if slist, ok := sv.([]interface{}); ok {
+					dst[k] = append(list, copyvalue(slist).([]interface{})...)
+				} else {
+					dst[k] = append(list, copyvalue(sv))
+				}
+			} else {
+				dst[k] = copyvalue(sv)
+			}
+		case MergeReplace:
+			dst[k] = copyvalue(sv)
+		}
+	}
+
+	if ordered {
+		dst[KeyOrder] = korder
+	}
+}
+
+// copyvalue returns a deep copy of the decoded value v
+func copyvalue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			m[k] = copyvalue(e)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(vv))
+		for i := range vv {
+			list[i] = copyvalue(vv[i])
+		}
+		return list
+	case []string:
+		return append([]string(nil), vv...)
+	}
+	return v
+}
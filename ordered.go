@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+/*
+ * Objects keeping their keys in order
+ */
+package ucl
+
+import "reflect"
+
+// An OrderedMap is an object that keeps its keys in the order they were
+// first set, as an alternative to maps carrying a KeyOrder entry. The zero
+// value is an empty map ready to use.
+type OrderedMap struct {
+	pairs []orderedpair
+	index map[string]int
+}
+
+type orderedpair struct {
+	key   string
+	value interface{}
+}
+
+var orderedMapType = reflect.TypeOf(OrderedMap{})
+
+// NewOrderedMap returns an empty OrderedMap.
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{}
+}
+
+// Len returns the number of keys in m.
+func (m *OrderedMap) Len() int {
+	return len(m.pairs)
+}
+
+// Get returns the value of key and whether it is present.
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	i, ok := m.index[key]
+	if !ok {
+		return nil, false
+	}
+	return m.pairs[i].value, true
+}
+
+// Set sets the value of key. A new key goes last; an existing one keeps its
+// place.
+func (m *OrderedMap) Set(key string, value interface{}) {
+	if i, ok := m.index[key]; ok {
+		m.pairs[i].value = value
+		return
+	}
+	if m.index == nil {
+		m.index = make(map[string]int)
+	}
+	m.index[key] = len(m.pairs)
+	m.pairs = append(m.pairs, orderedpair{key, value})
+}
+
+// Keys returns the keys of m in order.
+func (m *OrderedMap) Keys() []string {
+	keys := make([]string, len(m.pairs))
+	for i, p := range m.pairs {
+		keys[i] = p.key
+	}
+	return keys
+}
+
+// Range calls f for each key and value of m in order until f returns false.
+func (m *OrderedMap) Range(f func(key string, value interface{}) bool) {
+	for _, p := range m.pairs {
+		if !f(p.key, p.value) {
+			return
+		}
+	}
+}
+
+// keymap returns the keys and values of m as a map with a KeyOrder entry,
+// without converting the values
+func (m *OrderedMap) keymap() map[string]interface{} {
+	res := make(map[string]interface{}, len(m.pairs)+1)
+	for _, p := range m.pairs {
+		res[p.key] = p.value
+	}
+	res[KeyOrder] = m.Keys()
+	return res
+}
+
+// toordered converts the objects in the decoded value v, at every level, to
+// OrderedMaps
+func toordered(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := NewOrderedMap()
+		for _, k := range objkeys(vv) {
+			m.Set(k, toordered(vv[k]))
+		}
+		return m
+	case []interface{}:
+		for i := range vv {
+			vv[i] = toordered(vv[i])
+		}
+	}
+	return v
+}
@@ -30,10 +30,16 @@ package ucl
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -220,3 +226,2345 @@ EODX;
 	Encode(&ibuf, &ss, "   ", "json", `""`)
 	t.Log("\n" + ibuf.String())
 }
+
+// records stream events in a compact form
+type eventRecorder struct {
+	events []string
+}
+
+func (r *eventRecorder) OnKey(key string) error {
+	r.events = append(r.events, "key:"+key)
+	return nil
+}
+
+func (r *eventRecorder) OnScalar(value interface{}) error {
+	if value == nil {
+		r.events = append(r.events, "nil")
+	} else {
+		r.events = append(r.events, "val:"+value.(string))
+	}
+	return nil
+}
+
+func (r *eventRecorder) OnObjectStart() error {
+	r.events = append(r.events, "{")
+	return nil
+}
+
+func (r *eventRecorder) OnObjectEnd() error {
+	r.events = append(r.events, "}")
+	return nil
+}
+
+func (r *eventRecorder) OnArrayStart() error {
+	r.events = append(r.events, "[")
+	return nil
+}
+
+func (r *eventRecorder) OnArrayEnd() error {
+	r.events = append(r.events, "]")
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	s := `
+a = 1;
+none;
+section {
+	b "two";
+	list [ x, { c 3 } ];
+	nested key value;
+	another one { two 3; }
+}
+ml <<EOD
+text
+EOD
+`
+	expect := "{ key:a val:1 key:none nil key:section { key:b val:two " +
+		"key:list [ val:x { key:c val:3 } ] key:nested val:key value " +
+		"key:another { key:one { key:two val:3 } } } key:ml val:text }"
+
+	r := &eventRecorder{}
+	if err := NewDecoder(bytes.NewBufferString(s)).Stream(r); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for i, ev := range r.events {
+		if i > 0 {
+			got += " "
+		}
+		got += ev
+	}
+	if got != expect {
+		t.Errorf("unexpected events:\n%s\nexpected:\n%s", got, expect)
+	}
+}
+
+func TestDuplicateKeyMode(t *testing.T) {
+	s := `
+a 1;
+b {
+	c 2;
+
+	c 3;
+}
+a 4;
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := ucl["a"].([]interface{}); !ok || len(a) != 2 {
+		t.Error("expected array for repeated key, got", ucl["a"])
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetDuplicateKeyMode(DuplicateOverwrite)
+	if ucl, err = d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != "4" {
+		t.Error("expected last value for repeated key, got", ucl["a"])
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetDuplicateKeyMode(DuplicateError)
+	_, err = d.Decode()
+	dup, ok := err.(*DuplicateKeyError)
+	if !ok {
+		t.Fatal("expected DuplicateKeyError, got", err)
+	}
+	if dup.Key != "c" || dup.Line != 6 || dup.FirstLine != 4 {
+		t.Errorf("unexpected error contents: %v", dup)
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"[1, 2, 3]\n", `["1","2","3"]`},
+		{"[ { a 1 }, [ b ] ];\n", `[{"--ucl-keyorder--":["a"],"a":"1"},["b"]]`},
+		{`"hello world"` + "\n", `"hello world"`},
+		{"key value;\nother 1;\n", `{"--ucl-keyorder--":["key","other"],"key":"value","other":"1"}`},
+		{"{ a 1; }\n", `{"--ucl-keyorder--":["a"],"a":"1"}`},
+	}
+
+	for _, test := range tests {
+		v, err := NewDecoder(bytes.NewBufferString(test.in)).DecodeValue()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		b, _ := json.Marshal(v)
+		if string(b) != test.expect {
+			t.Errorf("%q: got %s, expected %s", test.in, b, test.expect)
+		}
+	}
+
+	_, err := NewDecoder(bytes.NewBufferString("[1] 2\n")).DecodeValue()
+	if err == nil {
+		t.Error("expected error for trailing value after array")
+	}
+
+	// documents of a single scalar
+	scalars := []struct {
+		in     string
+		typed  bool
+		expect interface{}
+	}{
+		{"'single'", false, "single"},
+		{"42", false, "42"},
+		{"42\n", true, int64(42)},
+		{"# answer\n 1.5; # more\n", true, 1.5},
+		{"yes", true, true},
+		{"yes", false, "yes"},
+		{`"yes"`, true, "yes"},
+		{"null\n", true, nil},
+		{"<<EOD\nline 1\n  line 2\nEOD\n", false, "line 1\n  line 2"},
+		{"<<EOD\n42\nEOD", true, "42"},
+		{"<<EOD\nEOD", false, ""},
+	}
+	for _, test := range scalars {
+		d := NewDecoder(bytes.NewBufferString(test.in))
+		d.SetTypedValues(test.typed)
+		v, err := d.DecodeValue()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if v != test.expect {
+			t.Errorf("%q: got %#v, expected %#v", test.in, v, test.expect)
+		}
+	}
+
+	d := NewDecoder(bytes.NewBufferString("12345678901234567890"))
+	d.SetUseNumber(true)
+	if v, err := d.DecodeValue(); err != nil || v != Number("12345678901234567890") {
+		t.Errorf("number: got %#v, %v", v, err)
+	}
+
+	// the heredoc must still be closed by its tag
+	for _, in := range []string{"<<EOD\nline\n", "<<EOD\nline\n EOD"} {
+		if _, err := NewDecoder(bytes.NewBufferString(in)).DecodeValue(); err == nil {
+			t.Errorf("%q: expected error for unterminated heredoc", in)
+		}
+	}
+}
+
+func TestInlineComments(t *testing.T) {
+	s := `/* before */ key /* between */ value /* after */;
+k2 = /* c */ v2; # trailing
+# whole line
+k3 /* c */ { a /* x */ 1; } /* after brace */
+k4 [ 1 /* in */, /* c */ 2 ]
+k5 v5 # ends the statement
+k6 /* multi
+line */ v6
+k7 # key without value
+`
+	ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(ucl)
+	expect := `{"--ucl-keyorder--":["key","k2","k3","k4","k5","k6","k7"],` +
+		`"k2":"v2","k3":{"--ucl-keyorder--":["a"],"a":"1"},"k4":["1","2"],` +
+		`"k5":"v5","k6":"v6","k7":null,"key":"value"}`
+	if string(b) != expect {
+		t.Errorf("got %s, expected %s", b, expect)
+	}
+}
+
+func TestBarewordTerminators(t *testing.T) {
+	tests := []struct {
+		set    string
+		in     string
+		expect string
+	}{
+		{DefaultBarewordTerminators, "a [x,y];\nb c,d;\n",
+			`{"--ucl-keyorder--":["a","b"],"a":["x","y"],"b":"c,d"}`},
+		{"", "a [x,y];\n",
+			`{"--ucl-keyorder--":["a"],"a":["x,y"]}`},
+		{",|", "a 1 | b \"2|3\" |c 4\nl [x | y, z];\n",
+			`{"--ucl-keyorder--":["a","b","c","l"],"a":"1","b":"2|3","c":"4","l":["x","y","z"]}`},
+	}
+
+	for _, test := range tests {
+		d := NewDecoder(bytes.NewBufferString(test.in))
+		d.SetBarewordTerminators(test.set)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		b, _ := json.Marshal(ucl)
+		if string(b) != test.expect {
+			t.Errorf("%q: got %s, expected %s", test.in, b, test.expect)
+		}
+	}
+}
+
+func TestDecodePartial(t *testing.T) {
+	s := `
+a 1;
+b { c 2; d [ 1, ; ] }
+e 3;
+`
+	ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if ucl == nil || ucl["a"] != "1" {
+		t.Fatal("key before error missing:", ucl)
+	}
+	if b, ok := ucl["b"].(map[string]interface{}); !ok || b["c"] != "2" {
+		t.Error("partial object missing:", ucl["b"])
+	}
+	if _, ok := ucl["e"]; ok {
+		t.Error("key after error present")
+	}
+}
+
+func TestNewDecoderReader(t *testing.T) {
+	s := "key value;\nsection { a 1; }\n"
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write([]byte(s))
+	zw.Close()
+
+	for _, in := range [][]byte{[]byte(s), zbuf.Bytes()} {
+		d, err := NewDecoderReader(bytes.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ucl["key"] != "value" {
+			t.Error("unexpected result", ucl)
+		}
+	}
+
+	// short input must not be mistaken for a header
+	if _, err := NewDecoderReader(bytes.NewReader([]byte("a"))); err != nil {
+		t.Error(err)
+	}
+}
+
+type testCloser struct {
+	io.Reader
+	closed int
+}
+
+func (c *testCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestDecoderClose(t *testing.T) {
+	s := "key value;\n"
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write([]byte(s))
+	zw.Close()
+
+	for _, in := range [][]byte{[]byte(s), zbuf.Bytes()} {
+		c := &testCloser{Reader: bytes.NewReader(in)}
+		d, err := NewDecoderReader(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ucl, err := d.Decode(); err != nil || ucl["key"] != "value" {
+			t.Errorf("got %v, %v", ucl, err)
+		}
+		if err = d.Close(); err != nil || c.closed != 1 {
+			t.Errorf("closed %d times, %v", c.closed, err)
+		}
+		if err = d.Close(); err != nil || c.closed != 1 {
+			t.Errorf("closed again, %d times, %v", c.closed, err)
+		}
+	}
+
+	c := &testCloser{Reader: bytes.NewBufferString(s)}
+	d := NewDecoder(c)
+	defer func() {
+		if c.closed != 1 {
+			t.Errorf("closed %d times", c.closed)
+		}
+	}()
+	defer d.Close()
+
+	// readers that cannot be closed are left alone
+	if err := NewDecoder(bytes.NewBufferString(s)).Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []string{
+		"a 1;\nb { c [1, 2]; }\n",
+		"{ a 1; }\n",
+		"",
+	}
+	invalid := []string{
+		"a { b 1;\n",
+		"a [ 1, 2 }\n",
+		"a ]\n",
+		"a [ 1, ; ]\n",
+		"a = b; }\n",
+	}
+
+	for _, s := range valid {
+		if err := Validate(bytes.NewBufferString(s)); err != nil {
+			t.Errorf("%q: unexpected error %v", s, err)
+		}
+	}
+	for _, s := range invalid {
+		if err := Validate(bytes.NewBufferString(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	data := largeConfig()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := Validate(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schemadoc := `
+type object;
+required [ name, port ];
+properties {
+	name { type string; }
+	port { type integer; }
+	mode { enum [ fast, slow ]; }
+	hosts { type array; items { type string; } }
+	server {
+		type object;
+		additionalProperties false;
+		properties { debug { type boolean; } }
+	}
+}
+`
+	schema, err := NewDecoder(bytes.NewBufferString(schemadoc)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := "name test;\nport 80;\nmode fast;\nhosts [ a, b ];\nserver { debug yes; }\n"
+	d := NewDecoder(bytes.NewBufferString(good))
+	d.SetSchema(schema)
+	if _, err = d.Decode(); err != nil {
+		t.Error("unexpected validation error:", err)
+	}
+
+	bad := `name test;
+port eighty;
+mode medium;
+hosts [ a, { b c } ];
+server {
+	debug yes;
+	extra 1;
+}
+`
+	d = NewDecoder(bytes.NewBufferString(bad))
+	d.SetSchema(schema)
+	_, err = d.Decode()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatal("expected ValidationErrors, got", err)
+	}
+	expect := []ValidationError{
+		{"port", 2, "expected integer"},
+		{"mode", 3, "medium is not one of fast, slow"},
+		{"hosts.1", 4, "expected string"},
+		{"server.extra", 7, "key not allowed"},
+	}
+	if len(errs) != len(expect) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i := range expect {
+		if *errs[i] != expect[i] {
+			t.Errorf("got %v, expected %v", *errs[i], expect[i])
+		}
+	}
+
+	d = NewDecoder(bytes.NewBufferString("name test;\n"))
+	d.SetSchema(schema)
+	if _, err = d.Decode(); err == nil || err.Error() != "missing required key port" {
+		t.Error("expected missing key error, got", err)
+	}
+}
+
+func TestDuplicateMixed(t *testing.T) {
+	docs := []string{
+		"key = [b, c]; key = a;\n",
+		"key = a; key = [b, c];\n",
+		"key = a; key = [b, c]; key = { d 1 };\n",
+	}
+	expect := map[int][]string{
+		DuplicateArray: {
+			`["b","c","a"]`,
+			`["a",["b","c"]]`,
+			`["a",["b","c"],{"--ucl-keyorder--":["d"],"d":"1"}]`,
+		},
+		DuplicateOverwrite: {
+			`"a"`,
+			`["b","c"]`,
+			`{"--ucl-keyorder--":["d"],"d":"1"}`,
+		},
+		DuplicateFlatten: {
+			`["b","c","a"]`,
+			`["a","b","c"]`,
+			`["a","b","c",{"--ucl-keyorder--":["d"],"d":"1"}]`,
+		},
+	}
+
+	for mode, results := range expect {
+		for i, s := range docs {
+			d := NewDecoder(bytes.NewBufferString(s))
+			d.SetDuplicateKeyMode(mode)
+			ucl, err := d.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := json.Marshal(ucl["key"])
+			if string(b) != results[i] {
+				t.Errorf("mode %d %q: got %s, expected %s", mode, s, b,
+					results[i])
+			}
+		}
+	}
+
+	for _, s := range docs {
+		d := NewDecoder(bytes.NewBufferString(s))
+		d.SetDuplicateKeyMode(DuplicateError)
+		if _, err := d.Decode(); err == nil {
+			t.Errorf("%q: expected duplicate key error", s)
+		}
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	s := `
+b1 true; b2 off; b3 Yes;
+i1 42; i2 -7; i3 0x1f;
+f1 1.5; f2 1e3;
+m1 10k; m2 2kb; m3 1.5mb;
+t1 30s; t2 100ms; t3 5min; t4 2h;
+q1 "42"; q2 'true';
+s1 hello; s2 inf; s3 10x;
+list [ 1, yes, 2.5, x ];
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetTypedValues(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]interface{}{
+		"b1": true, "b2": false, "b3": true,
+		"i1": int64(42), "i2": int64(-7), "i3": int64(31),
+		"f1": 1.5, "f2": 1000.0,
+		"m1": int64(10000), "m2": int64(2048), "m3": 1.5 * 1024 * 1024,
+		"t1": 30.0, "t2": 0.1, "t3": 300.0, "t4": 7200.0,
+		"q1": "42", "q2": "true",
+		"s1": "hello", "s2": "inf", "s3": "10x",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %#v, expected %#v", k, ucl[k], v)
+		}
+	}
+	b, _ := json.Marshal(ucl["list"])
+	if string(b) != `[1,true,2.5,"x"]` {
+		t.Errorf("list: got %s", b)
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	tests := []struct {
+		in   string
+		val  string
+		kind TokenKind
+		line int
+	}{
+		{"a 1;\nb \"unterminated\n", "unterminated\n", QUOTE, 3},
+		{"a 1;\nb {\n\tc 2;", "", WHITESPACE, 3},
+		{"a <<EOD\nline\n", "line\n", MLSTRING, 3},
+	}
+	for _, test := range tests {
+		d := NewDecoder(bytes.NewBufferString(test.in))
+		if _, err := d.Decode(); err == nil {
+			t.Errorf("%q: expected error", test.in)
+			continue
+		}
+		val, kind, line := d.LatestTag()
+		if val != test.val || kind != test.kind || line != test.line {
+			t.Errorf("%q: got %q %v %d, expected %q %v %d", test.in,
+				val, kind, line, test.val, test.kind, test.line)
+		}
+	}
+}
+
+// input ending inside a string or comment is an error, not a value
+func TestUnterminatedAtEOF(t *testing.T) {
+	for _, in := range []string{
+		"a \"open",
+		"a 'open\n",
+		"a 1; /* open",
+		"a 1; /* open *",
+		"a <<EOD\nline\n",
+	} {
+		_, err := NewDecoder(bytes.NewBufferString(in)).Decode()
+		if err != UnexpectedEOF {
+			t.Errorf("%q: got %v, expected %v", in, err, UnexpectedEOF)
+		}
+	}
+}
+
+func TestTypedArray(t *testing.T) {
+	s := `flags = [true, false, null, nil, 3, off, -1.5, "null"];
+nested [ [ yes, nil ], { k null } ]
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetTypedValues(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []interface{}{true, false, nil, nil, int64(3), false, -1.5, "null"}
+	if !reflect.DeepEqual(ucl["flags"], expect) {
+		t.Errorf("flags: got %#v, expected %#v", ucl["flags"], expect)
+	}
+	b, _ := json.Marshal(ucl["nested"])
+	if string(b) != `[[true,null],{"--ucl-keyorder--":["k"],"k":null}]` {
+		t.Errorf("nested: got %s", b)
+	}
+}
+
+func TestKeyTransform(t *testing.T) {
+	s := "Name a;\nPORT 1;\nname b;\nport 2;\nSub { Key x; KEY y }\n"
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetKeyTransform(strings.ToLower)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(ucl)
+	expect := `{"--ucl-keyorder--":["name","port","sub"],` +
+		`"name":["a","b"],"port":["1","2"],` +
+		`"sub":{"--ucl-keyorder--":["key"],"key":["x","y"]}}`
+	if string(b) != expect {
+		t.Errorf("got %s, expected %s", b, expect)
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetKeyTransform(strings.ToLower)
+	d.SetDuplicateKeyMode(DuplicateError)
+	_, err = d.Decode()
+	if de, ok := err.(*DuplicateKeyError); !ok || de.Key != "name" ||
+		de.Line != 3 || de.FirstLine != 1 {
+		t.Errorf("expected duplicate name at line 3, got %v", err)
+	}
+
+	// keys of nested sections, as in "section name { }", too
+	d = NewDecoder(bytes.NewBufferString("Section Name { Key 1; }\n"))
+	d.SetKeyTransform(strings.ToLower)
+	if ucl, err = d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = json.Marshal(ucl)
+	expect = `{"--ucl-keyorder--":["section"],` +
+		`"section":{"--ucl-keyorder--":["name"],` +
+		`"name":{"--ucl-keyorder--":["key"],"key":"1"}}}`
+	if string(b) != expect {
+		t.Errorf("got %s, expected %s", b, expect)
+	}
+}
+
+type testServer struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Debug bool
+}
+
+func TestUnmarshalTypedMaps(t *testing.T) {
+	s := `
+limits { cpu 2; mem 4k; }
+servers {
+	web { host a.example; port 80; Debug yes; }
+	db { host b.example; port 5432; }
+}
+ratios { a 0.5; b 2 }
+tags [ x, y ]
+single z;
+`
+	var cfg struct {
+		Limits  map[string]int         `json:"limits"`
+		Servers map[string]testServer  `json:"servers"`
+		Ratios  map[string]float32     `json:"ratios"`
+		Tags    []string               `json:"tags"`
+		Single  []string               `json:"single"`
+		Other   map[string]interface{} `json:"-"`
+	}
+	if err := Unmarshal([]byte(s), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Limits, map[string]int{"cpu": 2, "mem": 4000}) {
+		t.Errorf("limits: got %v", cfg.Limits)
+	}
+	expect := map[string]testServer{
+		"web": {"a.example", 80, true},
+		"db":  {"b.example", 5432, false},
+	}
+	if !reflect.DeepEqual(cfg.Servers, expect) {
+		t.Errorf("servers: got %v", cfg.Servers)
+	}
+	if cfg.Ratios["a"] != 0.5 || cfg.Ratios["b"] != 2 {
+		t.Errorf("ratios: got %v", cfg.Ratios)
+	}
+	if !reflect.DeepEqual(cfg.Tags, []string{"x", "y"}) ||
+		!reflect.DeepEqual(cfg.Single, []string{"z"}) {
+		t.Errorf("tags: got %v %v", cfg.Tags, cfg.Single)
+	}
+
+	var bad struct {
+		Servers map[string]testServer `json:"servers"`
+	}
+	err := Unmarshal([]byte("servers {\n\tweb {\n\t\tport eighty;\n\t}\n}\n"), &bad)
+	ue, ok := err.(*UnmarshalError)
+	if !ok || ue.Path != "servers.web.port" || ue.Line != 3 {
+		t.Errorf("expected error at servers.web.port line 3, got %v", err)
+	} else if ue.Error() != `servers.web.port (line 3): cannot store "eighty" in int` {
+		t.Errorf("got message %q", ue.Error())
+	}
+
+	var ints map[string]uint8
+	err = Unmarshal([]byte("a 1;\nb 300;\n"), &ints)
+	if ue, ok := err.(*UnmarshalError); !ok || ue.Path != "b" || ue.Line != 2 {
+		t.Errorf("expected overflow at b line 2, got %v", err)
+	}
+}
+
+type TestInner struct {
+	X int
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	type innerV struct{ V int }
+	type innerP struct{ X int }
+	var exported struct {
+		*TestInner
+		innerV
+		Y int
+	}
+	if err := Unmarshal([]byte("X 1; V 2; Y 3;"), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.TestInner == nil || exported.X != 1 || exported.V != 2 ||
+		exported.Y != 3 {
+		t.Errorf("got %+v", exported)
+	}
+
+	// fields promoted through a pointer to an unexported struct cannot be
+	// set and are skipped
+	var outerP struct {
+		*innerP
+		Y int
+	}
+	if err := Unmarshal([]byte("X 1; Y 2;"), &outerP); err != nil {
+		t.Fatal(err)
+	}
+	if outerP.innerP != nil || outerP.Y != 2 {
+		t.Errorf("got %+v", outerP)
+	}
+}
+
+func TestJSONInput(t *testing.T) {
+	js := `{
+	"name": "web",
+	"port": 8080, "ratio": 0.5,
+	"tls": true, "proxy": null,
+	"hosts": ["a", "b"],
+	"limits": {"cpu": 2, "mem": {"soft": 1, "hard": 2}},
+	"empty": {},
+	"none": []
+}
+`
+	native := `
+name web;
+port 8080; ratio 0.5;
+tls true; proxy null;
+hosts [a, b];
+limits { cpu 2; mem { soft 1; hard 2; } }
+empty {}
+none []
+`
+	d := NewDecoder(bytes.NewBufferString(js))
+	d.SetTypedValues(true)
+	fromjs, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = NewDecoder(bytes.NewBufferString(native))
+	d.SetTypedValues(true)
+	fromucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromjs, fromucl) {
+		t.Errorf("got %v, expected %v", fromjs, fromucl)
+	}
+	if fromjs["proxy"] != nil || fromjs["port"] != int64(8080) {
+		t.Errorf("unexpected values %v", fromjs)
+	}
+}
+
+func TestJSONCompat(t *testing.T) {
+	s := "a 1, b \"two\", c [x, y],\nd { e 1, f 2; g 3 }; h 4\n"
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	if _, err := d.Decode(); err == nil {
+		t.Errorf("expected error for top-level ',' after a quoted value")
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetJSONCompat(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"a": "1", "b": "two", "c": []interface{}{"x", "y"},
+		"d": map[string]interface{}{
+			"e": "1", "f": "2", "g": "3",
+			KeyOrder: []string{"e", "f", "g"},
+		},
+		"h":      "4",
+		KeyOrder: []string{"a", "b", "c", "d", "h"},
+	}
+	if !reflect.DeepEqual(ucl, expect) {
+		t.Errorf("got %v, expected %v", ucl, expect)
+	}
+
+	// without it a top-level ',' stays part of an unquoted value
+	ucl, err = NewDecoder(bytes.NewBufferString("a 1, b 2;\n")).Decode()
+	if err != nil || ucl["a"] != "1, b 2" {
+		t.Errorf("got %v, %v", ucl, err)
+	}
+}
+
+func TestDecodeStats(t *testing.T) {
+	s := `# servers
+a 1;
+b { c { d [1, [2]]; } } /* nested */
+a 2;
+e f g;
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	expect := DecodeStats{
+		KeysParsed:      6,
+		MaxDepth:        4,
+		BytesRead:       int64(len(s)),
+		CommentsSkipped: 2,
+	}
+	if st := d.Stats(); st != expect {
+		t.Errorf("got %+v, expected %+v", st, expect)
+	}
+}
+
+func TestSourceLine(t *testing.T) {
+	var b strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&b, "k%d %d;\r\n", i, i)
+	}
+	b.WriteString("bad {\n  x 1;\n  y ]\n  z 2;\n}\n")
+	d := NewDecoder(iotest.OneByteReader(strings.NewReader(b.String())))
+	if _, err := d.Decode(); err == nil {
+		t.Fatal("expected an error")
+	}
+	line := d.scanner.line
+	if line != 103 {
+		t.Fatalf("stopped at line %d", line)
+	}
+	if s, ok := d.SourceLine(line); !ok || s != "  y ]" {
+		t.Errorf("failing line: got %q, %v", s, ok)
+	}
+	if s, ok := d.SourceLine(100); !ok || s != "k100 100;" {
+		t.Errorf("line 100: got %q, %v", s, ok)
+	}
+	for _, n := range []int{0, 1, line - keptLines - 1, line + 1} {
+		if s, ok := d.SourceLine(n); ok {
+			t.Errorf("line %d: got %q, expected none", n, s)
+		}
+	}
+}
+
+func TestAdjacentTokens(t *testing.T) {
+	// A closing quote ends a token as whitespace would
+	tests := []struct {
+		in     string
+		spaced string
+	}{
+		{`"key""value";`, `"key" "value";`},
+		{`"key"value;`, `"key" value;`},
+		{`key"value";`, `key "value";`},
+		{`'key''value';`, `'key' 'value';`},
+		{`'key'"value";`, `'key' "value";`},
+		{`"k""";`, `"k" "";`},
+		{`""v;`, `"" v;`},
+		{`a "x"y z;`, `a "x" y z;`},
+		{`a x"y"z;`, `a x "y" z;`},
+		{`"a\"b"c;`, `"a\"b" c;`},
+		{`"k"{x 1;}`, `"k" {x 1;}`},
+		{`"k"[1, "2"3]`, `"k" [1, "2" 3]`},
+	}
+	for _, test := range tests {
+		got, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		expect, err := NewDecoder(bytes.NewBufferString(test.spaced)).Decode()
+		if err != nil {
+			t.Fatalf("%q: %v", test.spaced, err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: got %v, expected %v", test.in, got, expect)
+		}
+	}
+
+	ucl, err := NewDecoder(bytes.NewBufferString(`"key""value";`)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["key"] != "value" {
+		t.Errorf("got %v, expected key = value", ucl)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	s := "a 1;\nb { c [1, 2]; }\n"
+	d := NewDecoder(iotest.OneByteReader(bytes.NewBufferString(s)))
+	var seen []int64
+	d.SetProgressCallback(func(n int64) {
+		seen = append(seen, n)
+	})
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(s) {
+		t.Fatalf("got %d calls, expected %d", len(seen), len(s))
+	}
+	for i, n := range seen {
+		if n != int64(i+1) {
+			t.Fatalf("call %d: got %d bytes read", i, n)
+		}
+	}
+}
+
+func TestCommentChars(t *testing.T) {
+	tests := []struct {
+		single string
+		block  bool
+		in     string
+		keys   []string
+		expect map[string]string
+	}{
+		{";", true, "; header\na 1 ; note\nb x#y\nc { d 2 }\n/* e 3 */\n",
+			[]string{"a", "b", "c"},
+			map[string]string{"a": "1", "b": "x#y", "c.d": "2"}},
+		{";#", false, "# one\n; two\na 1;2\nb /*x*/\n",
+			[]string{"a", "b"}, map[string]string{"a": "1", "b": "/*x*/"}},
+		{"", false, "a #1;\nb 2 # x;\n",
+			[]string{"a", "b"}, map[string]string{"a": "#1", "b": "2 # x"}},
+		{"#", true, "a 1; # note\n/* b 2; */\n",
+			[]string{"a"}, map[string]string{"a": "1"}},
+	}
+	for _, test := range tests {
+		d := NewDecoder(bytes.NewBufferString(test.in))
+		d.SetCommentChars(test.single, test.block)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if keys := ucl[KeyOrder]; !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%q: got keys %v, expected %v", test.in, keys, test.keys)
+		}
+		for path, expect := range test.expect {
+			if got, _ := GetString(ucl, path); got != expect {
+				t.Errorf("%q: got %s = %q, expected %q", test.in, path, got,
+					expect)
+			}
+		}
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	for c := byte(0); c < ' '; c++ {
+		in := "a x" + string(c) + "y;\n"
+		_, err := NewDecoder(bytes.NewBufferString(in)).Decode()
+		if isspace(c) {
+			if err != nil {
+				t.Errorf("%q: %v", in, err)
+			}
+			continue
+		}
+		expect := fmt.Sprintf("unexpected control character %#02x at line 1, "+
+			"column 4", c)
+		if err == nil || err.Error() != expect {
+			t.Errorf("%q: got error %v, expected %q", in, err, expect)
+		}
+	}
+
+	// whitespace other than newlines separates a key from its value
+	for _, c := range "\t\v\f\r" {
+		in := "a" + string(c) + "1;\n"
+		ucl, err := NewDecoder(bytes.NewBufferString(in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+		} else if ucl["a"] != "1" {
+			t.Errorf("%q: got %v", in, ucl)
+		}
+	}
+
+	// quoted strings, heredocs and comments take any byte
+	in := "a \"x\x00y\";\nb <<EOD\n\x01\nEOD\n# \x00\n/* \x1b */\n"
+	ucl, err := NewDecoder(bytes.NewBufferString(in)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != "x\x00y" || ucl["b"] != "\x01" {
+		t.Errorf("got %q", ucl)
+	}
+}
+
+func TestLessThanLiteral(t *testing.T) {
+	tests := []struct {
+		in     string
+		key    string
+		expect string
+	}{
+		{"a max < 5;\n", "a", "max < 5"},
+		{"a <5;\n", "a", "<5"},
+		{"a 1<2\n", "a", "1<2"},
+		{"a <b;\n", "a", "<b"},
+		{"a <;\n", "a", "<"},
+		{"x<y 3;\n", "x<y", "3"},
+		{"a x<<;\n", "a", "x<<"},
+		{"a x<< y;\n", "a", "x<< y"},
+		{"a 1<<<2;\n", "a", "1<<<2"},
+		{"a 3 <<\n", "a", "3 <<"},
+		{"a <<EOD\n<x\nEOD\n", "a", "<x"},
+		{"x a<b;\n", "x", "a<b"},
+		{"a << EOD;\n", "a", "<< EOD"},
+		{"x a<<EOD\ntext\nEOD\n", "x", "a<<EOD"},
+		{"a=<<EOD\ntext\nEOD\n", "a", "text"},
+		{"a <<EOD\ntext\nEOD\n", "a", "text"},
+	}
+	for _, test := range tests {
+		ucl, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if ucl[test.key] != test.expect {
+			t.Errorf("%q: got %v, expected %s = %q", test.in, ucl,
+				test.key, test.expect)
+		}
+	}
+	// "<<" within a word does not begin a heredoc
+	ucl, err := NewDecoder(bytes.NewBufferString("a<<EOD\ntext\nEOD\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"a<<EOD", "text", "EOD"}
+	if !reflect.DeepEqual(ucl[KeyOrder], expect) {
+		t.Errorf("got keys %v, expected %v", ucl[KeyOrder], expect)
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("servers [\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&buf, "\t{ host h%d; port %d; opts { tls yes; } },\n", i, i)
+	}
+	buf.WriteString("];\n[servers]\nhost x;\n")
+
+	plain, err := NewDecoder(bytes.NewReader(buf.Bytes())).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(bytes.NewReader(buf.Bytes()))
+	d.SetInternStrings(true)
+	interned, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plain, interned) {
+		t.Errorf("interning changed the result: %v", interned)
+	}
+	if len(d.intern) != 5 || d.intern["host"] != "host" ||
+		d.intern["servers"] != "servers" {
+		t.Errorf("interned %v", d.intern)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	s := "big 123456789012345678901234567890;\nid 9007199254740993;\n" +
+		"ratio 0.1;\nmem 10k;\nhex 0x1f;\non yes;\nname \"42\";\n"
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetUseNumber(true)
+	d.SetTypedValues(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expect := range map[string]interface{}{
+		"big":   Number("123456789012345678901234567890"),
+		"id":    Number("9007199254740993"),
+		"ratio": Number("0.1"),
+		"mem":   Number("10k"),
+		"hex":   Number("0x1f"),
+		"on":    true,
+		"name":  "42",
+	} {
+		if ucl[k] != expect {
+			t.Errorf("%s: got %#v, expected %#v", k, ucl[k], expect)
+		}
+	}
+
+	if i, err := ucl["id"].(Number).Int64(); err != nil || i != 9007199254740993 {
+		t.Errorf("id: got %d, %v", i, err)
+	}
+	if i, err := ucl["mem"].(Number).Int64(); err != nil || i != 10000 {
+		t.Errorf("mem: got %d, %v", i, err)
+	}
+	if _, err := ucl["big"].(Number).Int64(); err == nil {
+		t.Errorf("big: expected error converting to int64")
+	}
+	if f, err := ucl["ratio"].(Number).Float64(); err != nil || f != 0.1 {
+		t.Errorf("ratio: got %v, %v", f, err)
+	}
+
+	delete(ucl, KeyOrder)
+	js, err := json.Marshal(ucl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"big":123456789012345678901234567890,"hex":31,"id":9007199254740993,` +
+		`"mem":10000,"name":"42","on":true,"ratio":0.1}`
+	if string(js) != expect {
+		t.Errorf("json: got %s, expected %s", js, expect)
+	}
+
+	var cfg struct {
+		ID  uint64 `json:"id"`
+		Mem int    `json:"mem"`
+		Big Number `json:"big"`
+	}
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetUseNumber(true)
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ID != 9007199254740993 || cfg.Mem != 10000 ||
+		cfg.Big != "123456789012345678901234567890" {
+		t.Errorf("unmarshal: got %+v", cfg)
+	}
+}
+
+// a key left without a value by the end of its line is an error when the
+// next lines look like its value
+func TestKeyWithoutValue(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"key\n  value\n", `key "key" at line 1 has no value before the ` +
+			`end of the line, but line 2 is indented under it; put the ` +
+			`value on the same line as the key, or enclose the indented ` +
+			`lines in { }`},
+		{"a {\n\tkey =\n\t\tvalue\n}\n", `key "key" at line 2 has no ` +
+			`value before the end of the line, but line 3 is indented under ` +
+			`it; put the value on the same line as the key, or enclose the ` +
+			`indented lines in { }`},
+		{"key\n{\n\ta 1\n}\n", `key "key" at line 1 has no value before ` +
+			`the end of the line; to give it the "{" at line 2, put that on ` +
+			`the same line as the key`},
+		{"key # comment\n[1, 2]\n", `key "key" at line 1 has no value ` +
+			`before the end of the line; to give it the "[" at line 2, put ` +
+			`that on the same line as the key`},
+	}
+	for _, test := range tests {
+		_, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err == nil || err.Error() != test.expect {
+			t.Errorf("%q: got error %v, expected %q", test.in, err, test.expect)
+		}
+	}
+
+	// keys without values are otherwise null
+	for _, in := range []string{"key\nother 1\n", "a {\n\tkey\n}\nother 1\n",
+		"key;\n  other 1\n"} {
+		ucl, err := NewDecoder(bytes.NewBufferString(in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+		} else if ucl["other"] != "1" {
+			t.Errorf("%q: got %v", in, ucl)
+		}
+	}
+}
+
+func TestBareKeyAsTrue(t *testing.T) {
+	in := "ssl;\noff false;\nnone null;\nlast\nsub { flag }\nafter 1\n"
+	tests := []struct {
+		typed, bare bool
+		expect      map[string]interface{}
+	}{
+		{false, false, map[string]interface{}{"ssl": nil, "off": "false",
+			"none": "null", "last": nil, "sub": map[string]interface{}{"flag": nil},
+			"after": "1"}},
+		{false, true, map[string]interface{}{"ssl": true, "off": "false",
+			"none": "null", "last": true, "sub": map[string]interface{}{"flag": true},
+			"after": "1"}},
+		{true, true, map[string]interface{}{"ssl": true, "off": false,
+			"none": nil, "last": true, "sub": map[string]interface{}{"flag": true},
+			"after": int64(1)}},
+	}
+	for _, test := range tests {
+		d := NewDecoder(bytes.NewBufferString(in))
+		d.SetTypedValues(test.typed)
+		d.SetBareKeyAsTrue(test.bare)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(ucl, KeyOrder)
+		delete(ucl["sub"].(map[string]interface{}), KeyOrder)
+		if !reflect.DeepEqual(ucl, test.expect) {
+			t.Errorf("typed %v, bare %v: got %v, expected %v", test.typed,
+				test.bare, ucl, test.expect)
+		}
+	}
+
+	var cfg struct {
+		SSL  bool `json:"ssl"`
+		HTTP bool `json:"http"`
+	}
+	d := NewDecoder(bytes.NewBufferString("ssl;\nhttp false;\n"))
+	d.SetBareKeyAsTrue(true)
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.SSL || cfg.HTTP {
+		t.Errorf("unmarshal: got %+v", cfg)
+	}
+}
+
+func TestStatementAtEOF(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect map[string]interface{}
+	}{
+		{"a 1\nk v", map[string]interface{}{"a": "1", "k": "v"}},
+		{"k", map[string]interface{}{"k": nil}},
+		{"k v # comment", map[string]interface{}{"k": "v"}},
+		{"\"k\" = \"v\"", map[string]interface{}{"k": "v"}},
+	}
+	for _, test := range tests {
+		ucl, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		delete(ucl, KeyOrder)
+		if !reflect.DeepEqual(ucl, test.expect) {
+			t.Errorf("%q: got %v, expected %v", test.in, ucl, test.expect)
+		}
+	}
+}
+
+func TestSingleLineObjects(t *testing.T) {
+	tests := []struct {
+		line  string
+		multi string
+	}{
+		{"point { x 1; y 2 }\n", "point {\n\tx 1\n\ty 2\n}\n"},
+		{"point {x 1;y 2;}\n", "point {\n\tx 1;\n\ty 2;\n}\n"},
+		{"a { b { c 1; d 2 }; e 3 }; f 4\n",
+			"a {\n\tb {\n\t\tc 1\n\t\td 2\n\t}\n\te 3\n}\nf 4\n"},
+		{"pts [ { x 1; y 2 }, { x 3; y 4 } ]\n",
+			"pts [\n\t{\n\t\tx 1\n\t\ty 2\n\t},\n\t{\n\t\tx 3\n\t\ty 4\n\t}\n]\n"},
+		{"pts [{x 1; y 2},{x 3}]; n 1\n",
+			"pts [\n\t{\n\t\tx 1\n\t\ty 2\n\t},\n\t{\n\t\tx 3\n\t}\n]\nn 1\n"},
+		{"a { b [ { c \"1\"; d = [e, { f g }] } ] }\n",
+			"a {\n\tb [\n\t\t{\n\t\t\tc \"1\"\n\t\t\td = [\n\t\t\t\te,\n" +
+				"\t\t\t\t{\n\t\t\t\t\tf g\n\t\t\t\t}\n\t\t\t]\n\t\t}\n\t]\n}\n"},
+	}
+	for _, test := range tests {
+		line, err := NewDecoder(bytes.NewBufferString(test.line)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		multi, err := NewDecoder(bytes.NewBufferString(test.multi)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.multi, err)
+			continue
+		}
+		if !reflect.DeepEqual(line, multi) {
+			t.Errorf("%q: got %v, expected %v", test.line, line, multi)
+		}
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	s := "listen 10.0.0.1;\nallow [127.0.0.1, \"::1\"];\ngateway 10.0.0.254;\n"
+	var cfg struct {
+		Listen  net.IP   `json:"listen"`
+		Allow   []net.IP `json:"allow"`
+		Gateway *net.IP  `json:"gateway"`
+	}
+	parseip := func(raw string) (interface{}, error) {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", raw)
+		}
+		return ip, nil
+	}
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.RegisterDecoder(reflect.TypeOf(net.IP{}), parseip)
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Listen.Equal(net.IPv4(10, 0, 0, 1)) || len(cfg.Allow) != 2 ||
+		!cfg.Allow[0].Equal(net.IPv4(127, 0, 0, 1)) ||
+		!cfg.Allow[1].Equal(net.IPv6loopback) ||
+		cfg.Gateway == nil || !cfg.Gateway.Equal(net.IPv4(10, 0, 0, 254)) {
+		t.Errorf("got %+v", cfg)
+	}
+
+	d = NewDecoder(bytes.NewBufferString("x 1;\nlisten 10.0.0.300;\n"))
+	d.RegisterDecoder(reflect.TypeOf(net.IP{}), parseip)
+	err := d.Unmarshal(&cfg)
+	ue, ok := err.(*UnmarshalError)
+	if !ok || ue.Path != "listen" || ue.Line != 2 ||
+		ue.Message != `invalid IP address "10.0.0.300"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCaseInsensitiveFields(t *testing.T) {
+	s := "Port 80;\nHOST example.com;\nname web;\nName other;\n"
+	var cfg struct {
+		Port int    `json:"port"`
+		Host string `json:"host"`
+		Name string `json:"name"`
+		Alt  string `json:"Name"`
+	}
+	if err := Unmarshal([]byte(s), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 0 || cfg.Host != "" {
+		t.Errorf("matched without SetCaseInsensitiveFields: %+v", cfg)
+	}
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetCaseInsensitiveFields(true)
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	// exact matches win over case-insensitive ones
+	if cfg.Port != 80 || cfg.Host != "example.com" || cfg.Name != "web" ||
+		cfg.Alt != "other" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	d = NewDecoder(bytes.NewBufferString("x 1;\nNAME web;\n"))
+	d.SetCaseInsensitiveFields(true)
+	err := d.Unmarshal(&cfg)
+	ue, ok := err.(*UnmarshalError)
+	if !ok || ue.Path != "NAME" || ue.Line != 2 ||
+		ue.Message != "matches fields Name, name" {
+		t.Errorf("expected ambiguous match error, got %v", err)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	type config struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	}
+	var cfg config
+	if err := DecodeStrict(strings.NewReader("name web;\nport 80;\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "web" || cfg.Port != 80 {
+		t.Errorf("got %+v", cfg)
+	}
+
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"name web;\nhost x;\n", "host (line 2): unknown field"},
+		{"name web;\nport 80;\nname db;\n",
+			`duplicate key "name" at line 3, first defined at line 1`},
+		{"name web;\n}\n", "unexpected '}' at line 2, column 1; nothing to close"},
+		{"{ name web; } port 80;\n", "unexpected 'port' after value at line 1"},
+		{"{ name web; } }\n", "unexpected '}' at line 1, column 15; nothing to close"},
+		{"{ name web; }\n{ port 80; }\n", "unexpected '{' after value at line 2"},
+	}
+	for _, test := range tests {
+		err := DecodeStrict(strings.NewReader(test.in), &cfg)
+		if err == nil || err.Error() != test.expect {
+			t.Errorf("%q: got error %v, expected %q", test.in, err, test.expect)
+		}
+	}
+}
+
+func TestUnmarshalRemain(t *testing.T) {
+	s := "name web;\nport 80;\nplugin { a 1; }\nlevel 3;\n"
+	var cfg struct {
+		Name  string                 `json:"name"`
+		Extra map[string]interface{} `json:",remain"`
+	}
+	if err := Unmarshal([]byte(s), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "web" || len(cfg.Extra) != 3 || cfg.Extra["port"] != "80" ||
+		cfg.Extra["level"] != "3" {
+		t.Errorf("got %+v", cfg)
+	}
+	if p, ok := cfg.Extra["plugin"].(map[string]interface{}); !ok || p["a"] != "1" {
+		t.Errorf("plugin: got %v", cfg.Extra["plugin"])
+	}
+
+	// the remain field suppresses unknown field errors
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.DisallowUnknownFields()
+	cfg.Extra = nil
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Extra) != 3 {
+		t.Errorf("got %+v", cfg)
+	}
+
+	var strict struct {
+		Name string `json:"name"`
+	}
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.DisallowUnknownFields()
+	err := d.Unmarshal(&strict)
+	ue, ok := err.(*UnmarshalError)
+	if !ok || ue.Path != "port" || ue.Line != 2 || ue.Message != "unknown field" {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+
+	// nested structs without a remain field still fail
+	var nested struct {
+		Sub struct {
+			A int `json:"a"`
+		} `json:"plugin"`
+		Extra map[string]string `json:",remain"`
+	}
+	d = NewDecoder(bytes.NewBufferString("plugin { a 1; b 2; }\nx y;\n"))
+	d.DisallowUnknownFields()
+	err = d.Unmarshal(&nested)
+	if ue, ok := err.(*UnmarshalError); !ok || ue.Path != "plugin.b" {
+		t.Errorf("expected unknown field plugin.b, got %v", err)
+	}
+
+	var bad struct {
+		Extra []string `json:",remain"`
+	}
+	if err := Unmarshal([]byte(s), &bad); err == nil {
+		t.Error("expected error for a remain field that is not a map")
+	}
+}
+
+func TestUnmarshalPointerSlices(t *testing.T) {
+	type server struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	type config struct {
+		Servers []*server `json:"servers"`
+		Ports   []*int    `json:"ports"`
+		Backup  *server   `json:"backup"`
+		Name    *string   `json:"name"`
+		Names   []*string `json:"names"`
+	}
+	s := "servers [{ host a; port 80; }, null, { host b; }];\n" +
+		"ports [1, nil, 3];\nbackup null;\nname \"null\";\n" +
+		"names [a, null, \"nil\"];\n"
+	for _, typed := range []bool{false, true} {
+		var cfg config
+		d := NewDecoder(bytes.NewBufferString(s))
+		d.SetTypedValues(typed)
+		if err := d.Unmarshal(&cfg); err != nil {
+			t.Fatalf("typed %v: %v", typed, err)
+		}
+		if len(cfg.Servers) != 3 || cfg.Servers[1] != nil ||
+			*cfg.Servers[0] != (server{"a", 80}) ||
+			*cfg.Servers[2] != (server{"b", 0}) {
+			t.Errorf("typed %v: servers: got %v", typed, cfg.Servers)
+		}
+		if len(cfg.Ports) != 3 || cfg.Ports[1] != nil ||
+			*cfg.Ports[0] != 1 || *cfg.Ports[2] != 3 {
+			t.Errorf("typed %v: ports: got %v", typed, cfg.Ports)
+		}
+		if cfg.Backup != nil {
+			t.Errorf("typed %v: backup: got %v", typed, cfg.Backup)
+		}
+		// quoted, null and nil are strings
+		if cfg.Name == nil || *cfg.Name != "null" {
+			t.Errorf("typed %v: name: got %v", typed, cfg.Name)
+		}
+		if len(cfg.Names) != 3 || *cfg.Names[0] != "a" ||
+			cfg.Names[1] != nil || *cfg.Names[2] != "nil" {
+			t.Errorf("typed %v: names: got %v", typed, cfg.Names)
+		}
+	}
+
+	// a single value is the only element
+	var cfg config
+	if err := Unmarshal([]byte("ports 8;\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Ports) != 1 || *cfg.Ports[0] != 8 {
+		t.Errorf("single: got %v", cfg.Ports)
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	s := "z 1;\nb { y 2; a [ { q 3; c 4; } ]; }\nm 5;\n"
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetUseOrderedMap(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := ucl["b"].(*OrderedMap)
+	if !ok {
+		t.Fatalf("got %T for b, expected *OrderedMap", ucl["b"])
+	}
+	if keys := b.Keys(); !reflect.DeepEqual(keys, []string{"y", "a"}) {
+		t.Errorf("got keys %v", keys)
+	}
+	if v, ok := GetString(ucl, "b.a.0.c"); !ok || v != "4" {
+		t.Errorf("b.a.0.c: got %q, %v", v, ok)
+	}
+	inner, _ := Get(ucl, "b.a.0")
+	if keys := inner.(*OrderedMap).Keys(); !reflect.DeepEqual(keys,
+		[]string{"q", "c"}) {
+		t.Errorf("got keys %v", keys)
+	}
+
+	root, err := NewDecoder(bytes.NewBufferString(s)).DecodeOrdered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	root.Range(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return k != "b"
+	})
+	if !reflect.DeepEqual(keys, []string{"z", "b"}) {
+		t.Errorf("Range: got keys %v", keys)
+	}
+	if _, ok := root.Get(KeyOrder); ok || root.Len() != 3 {
+		t.Errorf("got %d keys, KeyOrder present %v", root.Len(), ok)
+	}
+
+	var m OrderedMap
+	m.Set("x", 1)
+	m.Set("y", 2)
+	m.Set("x", 3)
+	if v, _ := m.Get("x"); v != 3 || !reflect.DeepEqual(m.Keys(),
+		[]string{"x", "y"}) {
+		t.Errorf("got %v, keys %v", v, m.Keys())
+	}
+}
+
+func TestINISections(t *testing.T) {
+	s := `top 1;
+[database]
+host db;
+ports [5432, 5433];
+
+["web server"]
+nested { list [x] }
+[database]
+user u
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetINISections(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"top": "1",
+		"database": map[string]interface{}{
+			"host":   "db",
+			"ports":  []interface{}{"5432", "5433"},
+			"user":   "u",
+			KeyOrder: []string{"host", "ports", "user"},
+		},
+		"web server": map[string]interface{}{
+			"nested": map[string]interface{}{
+				"list":   []interface{}{"x"},
+				KeyOrder: []string{"list"},
+			},
+			KeyOrder: []string{"nested"},
+		},
+		KeyOrder: []string{"top", "database", "web server"},
+	}
+	if !reflect.DeepEqual(ucl, expect) {
+		t.Errorf("got %v, expected %v", ucl, expect)
+	}
+
+	// bracketed lists are still arrays
+	d = NewDecoder(bytes.NewBufferString("[a]\nb [1, 2];\nc [3];\n"))
+	d.SetINISections(true)
+	ucl, err = d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, _ := ucl["a"].(map[string]interface{})
+	if !reflect.DeepEqual(sec["b"], []interface{}{"1", "2"}) ||
+		!reflect.DeepEqual(sec["c"], []interface{}{"3"}) {
+		t.Errorf("got %v", ucl)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := `
+name web;
+hosts [a, b];
+tls { cert base.pem; port 443; }
+debug off;
+`
+	env := `
+debug on;
+hosts c;
+tls { port 8443; ciphers [x]; }
+extra 1;
+`
+	decode := func(s string) map[string]interface{} {
+		ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ucl
+	}
+
+	tests := []struct {
+		mode   MergeMode
+		hosts  []interface{}
+		port   string
+		debug  string
+		korder []string
+	}{
+		{MergeAppend, []interface{}{"a", "b", "c"}, "8443", "on",
+			[]string{"cert", "port", "ciphers"}},
+		{MergeReplace, nil, "8443", "on",
+			[]string{"cert", "port", "ciphers"}},
+		{MergeKeep, []interface{}{"a", "b"}, "443", "off",
+			[]string{"cert", "port", "ciphers"}},
+	}
+	for _, test := range tests {
+		dst, src := decode(base), decode(env)
+		if err := Merge(dst, src, test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if test.mode == MergeReplace {
+			if dst["hosts"] != "c" {
+				t.Errorf("%d: hosts: got %v", test.mode, dst["hosts"])
+			}
+		} else if !reflect.DeepEqual(dst["hosts"], test.hosts) {
+			t.Errorf("%d: hosts: got %v", test.mode, dst["hosts"])
+		}
+		tls := dst["tls"].(map[string]interface{})
+		if tls["port"] != test.port || tls["cert"] != "base.pem" ||
+			dst["debug"] != test.debug || dst["extra"] != "1" {
+			t.Errorf("%d: got %v", test.mode, dst)
+		}
+		if !reflect.DeepEqual(tls[KeyOrder], test.korder) ||
+			!reflect.DeepEqual(dst[KeyOrder],
+				[]string{"name", "hosts", "tls", "debug", "extra"}) {
+			t.Errorf("%d: key order %v, %v", test.mode, dst[KeyOrder],
+				tls[KeyOrder])
+		}
+
+		// dst must not share values with src
+		tls["ciphers"].([]interface{})[0] = "changed"
+		if src["tls"].(map[string]interface{})["ciphers"].([]interface{})[0] != "x" {
+			t.Errorf("%d: merged value shared with src", test.mode)
+		}
+	}
+
+	if err := Merge(nil, decode(env), MergeAppend); err == nil {
+		t.Error("expected error merging into nil")
+	}
+	if err := Merge(decode(base), decode(env), MergeMode(9)); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestTrackOffsets(t *testing.T) {
+	s := "a 1;\nname = \"web server\"\nobj {\n\tx [1, 2];\n}\n" +
+		"list [a, b]\nh <<EOD\nhi\nEOD\nr /x+/;\nn;\nlast  value here  "
+	expect := map[string]string{
+		"a":    "1",
+		"name": `"web server"`,
+		"obj":  "{\n\tx [1, 2];\n}",
+		"list": "[a, b]",
+		"h":    "<<EOD\nhi\nEOD",
+		"r":    "/x+/",
+		"last": "value here",
+	}
+
+	// spans must survive refills of the scanner's buffer
+	for _, r := range []io.Reader{strings.NewReader(s),
+		iotest.OneByteReader(strings.NewReader(s))} {
+
+		d := NewDecoder(r)
+		d.SetTrackOffsets(true)
+		if _, err := d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		offsets := d.Offsets()
+		if len(offsets) != len(expect) {
+			t.Errorf("got %v", offsets)
+		}
+		for k, v := range expect {
+			sp, ok := offsets[k]
+			if !ok || s[sp[0]:sp[1]] != v {
+				t.Errorf("%s: got span %v, expected %q", k, sp, v)
+			}
+		}
+	}
+
+	d := NewDecoder(strings.NewReader(s))
+	if _, err := d.Decode(); err != nil || d.Offsets() != nil {
+		t.Errorf("offsets tracked by default: %v, %v", d.Offsets(), err)
+	}
+}
+
+func TestUnmarshalDurationSize(t *testing.T) {
+	s := `
+timeout 30s;
+retry 5min;
+poll 1h30m;
+idle 90;
+limit 10mb;
+buffer 4k;
+chunk 512b;
+plain 4k;
+`
+	var cfg struct {
+		Timeout time.Duration  `json:"timeout"`
+		Retry   time.Duration  `json:"retry"`
+		Poll    *time.Duration `json:"poll"`
+		Idle    time.Duration  `json:"idle"`
+		Limit   int64          `json:"limit,bytes"`
+		Buffer  *uint32        `json:"buffer,bytes"`
+		Chunk   int            `json:"chunk,bytes"`
+		Plain   int            `json:"plain"`
+	}
+	if err := Unmarshal([]byte(s), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timeout != 30*time.Second || cfg.Retry != 5*time.Minute ||
+		cfg.Poll == nil || *cfg.Poll != 90*time.Minute ||
+		cfg.Idle != 90*time.Second {
+		t.Errorf("durations: got %v %v %v %v", cfg.Timeout, cfg.Retry,
+			cfg.Poll, cfg.Idle)
+	}
+	if cfg.Limit != 10<<20 || cfg.Buffer == nil || *cfg.Buffer != 4<<10 ||
+		cfg.Chunk != 512 || cfg.Plain != 4000 {
+		t.Errorf("sizes: got %v %v %v %v", cfg.Limit, cfg.Buffer, cfg.Chunk,
+			cfg.Plain)
+	}
+
+	// typed values arrive as seconds
+	d := NewDecoder(bytes.NewBufferString("timeout 1.5s;\n"))
+	d.SetTypedValues(true)
+	if err := d.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timeout != 1500*time.Millisecond {
+		t.Errorf("typed duration: got %v", cfg.Timeout)
+	}
+
+	for _, in := range []string{"timeout soon;\n", "limit lots;\n"} {
+		err := Unmarshal([]byte(in), &cfg)
+		if _, ok := err.(*UnmarshalError); !ok {
+			t.Errorf("%q: expected UnmarshalError, got %v", in, err)
+		}
+	}
+}
+
+func TestDecodeSection(t *testing.T) {
+	s := `
+servers {
+	web { host a.example; port 80; }
+	db { host b.example; port 5432; }
+}
+listen [ 80, 443 ];
+`
+	var srv testServer
+	d := NewDecoder(bytes.NewBufferString(s))
+	if err := d.DecodeSection("servers.db", &srv); err != nil {
+		t.Fatal(err)
+	}
+	if srv != (testServer{"b.example", 5432, false}) {
+		t.Errorf("got %v", srv)
+	}
+
+	var port int
+	d = NewDecoder(bytes.NewBufferString(s))
+	if err := d.DecodeSection("listen.1", &port); err != nil || port != 443 {
+		t.Errorf("listen.1: got %d, %v", port, err)
+	}
+
+	for _, path := range []string{"servers.mail", "listen.2", "listen.0.x"} {
+		d = NewDecoder(bytes.NewBufferString(s))
+		err := d.DecodeSection(path, &srv)
+		if ue, ok := err.(*UnmarshalError); !ok || ue.Path != path {
+			t.Errorf("%s: expected not found, got %v", path, err)
+		}
+	}
+}
+
+func TestSpaceSeparatedArrays(t *testing.T) {
+	s := `
+one 80;
+two 80 443;
+many  80 443   ssl http2 ;
+quoted "a b c";
+nested { listen 1 2 }
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetSpaceSeparatedArrays(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(ucl, KeyOrder)
+	b, _ := json.Marshal(ucl)
+	expect := `{"many":["80","443","ssl","http2"],` +
+		`"nested":{"--ucl-keyorder--":["listen"],"listen":["1","2"]},` +
+		`"one":"80","quoted":"a b c","two":["80","443"]}`
+	if string(b) != expect {
+		t.Errorf("got %s, expected %s", b, expect)
+	}
+
+	d = NewDecoder(bytes.NewBufferString("two 80 on;\n"))
+	d.SetSpaceSeparatedArrays(true)
+	d.SetTypedValues(true)
+	ucl, err = d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ucl["two"], []interface{}{int64(80), true}) {
+		t.Errorf("typed: got %#v", ucl["two"])
+	}
+}
+
+func TestGet(t *testing.T) {
+	s := `
+servers [
+	{ host a; port 80; },
+	{ host b; tags [ x, y ] },
+]
+empty [];
+name top;
+`
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetTypedValues(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := []struct {
+		path   string
+		expect string
+	}{
+		{"name", "top"},
+		{"servers.0.host", "a"},
+		{"servers.-1.host", "b"},
+		{"servers.-2.port", "80"},
+		{"servers.1.tags.-1", "y"},
+		{"servers.-1.tags.0", "x"},
+	}
+	for _, test := range found {
+		if v, ok := GetString(ucl, test.path); !ok || v != test.expect {
+			t.Errorf("%s: got %q, %v, expected %q", test.path, v, ok,
+				test.expect)
+		}
+	}
+
+	for _, path := range []string{"servers.2.host", "servers.-3.host",
+		"servers.0.5.host", "servers.x", "empty.0", "empty.-1",
+		"name.0", "missing", KeyOrder} {
+		if v, ok := Get(ucl, path); ok {
+			t.Errorf("%s: expected not found, got %v", path, v)
+		}
+	}
+
+	if _, ok := GetString(ucl, "servers.0"); ok {
+		t.Error("GetString of an object should fail")
+	}
+	if v, ok := Get(ucl, "empty"); !ok || len(v.([]interface{})) != 0 {
+		t.Errorf("empty: got %v, %v", v, ok)
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	s := "a one \\\n    two \\\n\tthree;\n" +
+		"b \"abc\\\ndef\";\n" +
+		"c x\\\n;\n" +
+		"d 1\n"
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetLineContinuation(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"a": "one two three", "b": "abcdef", "c": "x", "d": "1",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %q, expected %q", k, ucl[k], v)
+		}
+	}
+
+	// a backslash not ending the line is still an error
+	d = NewDecoder(bytes.NewBufferString("a one \\ two;\n"))
+	d.SetLineContinuation(true)
+	if _, err = d.Decode(); err == nil {
+		t.Error("expected error for backslash within line")
+	}
+	if _, err = NewDecoder(bytes.NewBufferString(s)).Decode(); err == nil {
+		t.Error("expected error without continuation")
+	}
+}
+
+func TestNewlineTerminates(t *testing.T) {
+	s := "a first\nsecond;\nb 1;\nc {\n\td x\n\ty\n}\ne one # note\n;\n"
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetNewlineTerminates(false)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(ucl)
+	expect := `{"--ucl-keyorder--":["a","b","c","e"],"a":"first\nsecond","b":"1",` +
+		`"c":{"--ucl-keyorder--":["d"],"d":"x\n\ty"},"e":"one"}`
+	if string(b) != expect {
+		t.Errorf("got %s, expected %s", b, expect)
+	}
+
+	ucl, err = NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ucl["second"]; ucl["a"] != "first" || !ok {
+		t.Errorf("default: got %v", ucl)
+	}
+}
+
+func TestAfterBraceClose(t *testing.T) {
+	// a closing brace ends the statement, so what follows on the same
+	// line starts the next one
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"a { key value } extra more\n",
+			`{"a":{"key":"value"},"extra":"more"}`},
+		{"a { key value } extra\n",
+			`{"a":{"key":"value"},"extra":null}`},
+		{"o { a { k v } e f }\n",
+			`{"o":{"a":{"k":"v"},"e":"f"}}`},
+		{"l [ { k v } x ]\n",
+			`{"l":[{"k":"v"},"x"]}`},
+	}
+	UclExportKeyOrder = false
+	defer func() { UclExportKeyOrder = true }()
+	for _, test := range tests {
+		ucl, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		b, _ := json.Marshal(ucl)
+		if string(b) != test.expect {
+			t.Errorf("%q: got %s, expected %s", test.in, b, test.expect)
+		}
+	}
+
+	_, err := NewDecoder(bytes.NewBufferString("o { k v } } x\n")).Decode()
+	if err == nil || !strings.Contains(err.Error(), "at line 1") {
+		t.Errorf("expected error for extra '}', got %v", err)
+	}
+}
+
+func TestHeredocTrim(t *testing.T) {
+	s := "script <<EOD\n" +
+		"    if x; then\n" +
+		"        run\n" +
+		"\n" +
+		"    \tfi\n" +
+		"EOD\n"
+	tests := []struct {
+		mode   int
+		expect string
+	}{
+		{HeredocTrimNone, "    if x; then\n        run\n\n    \tfi"},
+		{HeredocTrimLeadingWhitespace, "if x; then\nrun\n\nfi"},
+		{HeredocTrimCommonIndent, "if x; then\n    run\n\n\tfi"},
+	}
+	for _, test := range tests {
+		d := NewDecoder(bytes.NewBufferString(s))
+		d.SetHeredocTrim(test.mode)
+		ucl, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ucl["script"] != test.expect {
+			t.Errorf("mode %d: got %q, expected %q", test.mode,
+				ucl["script"], test.expect)
+		}
+	}
+
+	// tabs and spaces only share the common prefix
+	mixed := "m <<EOD\n\t  a\n\t b\nEOD\n"
+	d := NewDecoder(bytes.NewBufferString(mixed))
+	d.SetHeredocTrim(HeredocTrimCommonIndent)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["m"] != " a\nb" {
+		t.Errorf("mixed: got %q", ucl["m"])
+	}
+}
+
+func TestHeredocHeader(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"a <<EO-D\nx\nEO-D\n", `heredoc tag "EO" at line 1 must be an ` +
+			`identifier followed by a newline, found '-'`},
+		{"a <<EOD;\nx\nEOD\n", `heredoc tag "EOD" at line 1 must be an ` +
+			`identifier followed by a newline, found ';'`},
+		{"a <<EOD  x\nx\nEOD\n", `heredoc tag "EOD" at line 1 must be an ` +
+			`identifier followed by a newline, found 'x'`},
+		{"a\nb c d <<EOD\nx\nEOD\n", `heredoc at line 2 must directly ` +
+			`follow a single key, not "c d"`},
+	}
+	for _, test := range tests {
+		_, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err == nil || err.Error() != test.expect {
+			t.Errorf("%q: got error %v, expected %q", test.in, err, test.expect)
+		}
+	}
+
+	// whitespace may follow the tag
+	ucl, err := NewDecoder(bytes.NewBufferString("a <<EOD \t\r\nx\nEOD\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != "x" {
+		t.Errorf("got %v", ucl)
+	}
+}
+
+func TestHeredocEscapedDelimiter(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"a <<EOD\nEODX\nEOD2\n EOD\nEOD \nEOD\n", "EODX\nEOD2\n EOD\nEOD "},
+		{"a <<EOD\n\\EOD\nx\nEOD\n", "EOD\nx"},
+		{"a <<EOD\n\\\\EOD\n\\EODX\n\\EOD;\nEOD\n", "\\EOD\n\\EODX\nEOD;"},
+		{"a <<EOD\nx;EOD\ny\nEOD\n", "x;EOD\ny"},
+		{"a <<EOD\nEOD\n", ""},
+	}
+	for _, test := range tests {
+		ucl, err := NewDecoder(bytes.NewBufferString(test.in)).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if ucl["a"] != test.expect {
+			t.Errorf("%q: got %q, expected %q", test.in, ucl["a"], test.expect)
+		}
+	}
+
+	// escapes are removed before trimming
+	d := NewDecoder(bytes.NewBufferString("a <<EOD\n\t\\EOD\n\\EOD\nEOD\n"))
+	d.SetHeredocTrim(HeredocTrimLeadingWhitespace)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != "\\EOD\nEOD" {
+		t.Errorf("trimmed: got %q", ucl["a"])
+	}
+}
+
+func TestRegexValues(t *testing.T) {
+	s := "a /x\\/y\\ [a-z]{2}/;\nb [ /\\d+\\ (k|m)#/, /u\\ v/ ];\nc /usr/lib;\n"
+	ucl, err := NewDecoder(bytes.NewBufferString(s)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != `/x\/y\ [a-z]{2}/` || ucl["c"] != "/usr/lib" {
+		t.Errorf("got %v", ucl)
+	}
+
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetTypedValues(true)
+	if ucl, err = d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"a": Regex("x/y [a-z]{2}"),
+		"b": []interface{}{Regex(`\d+ (k|m)#`), Regex("u v")},
+		"c": "/usr/lib",
+	}
+	for k, v := range expect {
+		if !reflect.DeepEqual(ucl[k], v) {
+			t.Errorf("%s: got %#v, expected %#v", k, ucl[k], v)
+		}
+	}
+}
+
+func TestAnchors(t *testing.T) {
+	s := "base &defaults { port 80; hosts [a, b]; }\n" +
+		"dev *defaults\n" +
+		"name &n web 1;\n" +
+		"list [&one 1, *one, *n];\n" +
+		"last { x &end 2 }\n" +
+		"again *end\n"
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetAnchors(true)
+	ucl, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ucl["dev"], ucl["base"]) {
+		t.Errorf("dev: got %v, expected %v", ucl["dev"], ucl["base"])
+	}
+	if ucl["name"] != "web 1" {
+		t.Errorf("name: got %q", ucl["name"])
+	}
+	if l := ucl["list"]; !reflect.DeepEqual(l, []interface{}{"1", "1", "web 1"}) {
+		t.Errorf("list: got %v", l)
+	}
+	if ucl["again"] != "2" {
+		t.Errorf("again: got %v", ucl["again"])
+	}
+	ucl["dev"].(map[string]interface{})["port"] = "8080"
+	if p := ucl["base"].(map[string]interface{})["port"]; p != "80" {
+		t.Errorf("copied alias changed base port to %v", p)
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetAnchors(true)
+	d.SetAliasMode(AliasShare)
+	if ucl, err = d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	ucl["dev"].(map[string]interface{})["port"] = "8080"
+	if p := ucl["base"].(map[string]interface{})["port"]; p != "8080" {
+		t.Errorf("shared alias left base port at %v", p)
+	}
+
+	// without SetAnchors the markers are ordinary text
+	ucl, err = NewDecoder(bytes.NewBufferString("a &x 1;\nb *x;\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["a"] != "&x 1" || ucl["b"] != "*x" {
+		t.Errorf("got %v", ucl)
+	}
+
+	errs := []struct {
+		in, err string
+	}{
+		{"a 1;\nb *x;\n", "undefined alias *x at line 2"},
+		{"a &x {\n\tb *x;\n}\n", "alias *x at line 2 refers to the value of " +
+			"anchor &x at line 1 enclosing it"},
+		{"a &x;\n", "anchor &x at line 1 has no value"},
+		{"a [1, *y];\n", "undefined alias *y at line 1"},
+	}
+	for _, test := range errs {
+		d := NewDecoder(bytes.NewBufferString(test.in))
+		d.SetAnchors(true)
+		if _, err := d.Decode(); err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, expected %q", test.in, err, test.err)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a, err := NewDecoder(bytes.NewBufferString(
+		"port 80;\nname web;\nsub { on yes; size 1k; }\nlist [1, 2.5];\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := map[string]interface{}{
+		"sub":  map[string]interface{}{"size": "1k", "on": "yes"},
+		"name": "web",
+		"list": []interface{}{"1", "2.5"},
+		"port": "80",
+	}
+	if !Equal(a, b) {
+		t.Errorf("Equal(%v, %v) is false", a, b)
+	}
+	m, err := NewDecoder(bytes.NewBufferString("a 1;\n")).DecodeOrdered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Equal(map[string]interface{}{"x": m},
+		map[string]interface{}{"x": map[string]interface{}{"a": "1"}}) {
+		t.Error("OrderedMap differs from map")
+	}
+
+	typed := map[string]interface{}{
+		"sub":  map[string]interface{}{"size": 1000, "on": true},
+		"name": "web",
+		"list": []interface{}{int64(1), 2.5},
+		"port": Number("80"),
+	}
+	if Equal(a, typed) {
+		t.Errorf("Equal(%v, %v) is true", a, typed)
+	}
+	if !EqualValues(a, typed) {
+		t.Errorf("EqualValues(%v, %v) is false", a, typed)
+	}
+
+	for _, c := range []map[string]interface{}{
+		{"port": "81", "name": "web", "sub": typed["sub"], "list": typed["list"]},
+		{"port": 80, "name": "web", "sub": typed["sub"], "list": []interface{}{1}},
+		{"port": 80, "name": "web", "sub": typed["sub"]},
+		{"port": 80, "name": "web", "sub": typed["sub"], "list": typed["list"], "x": nil},
+	} {
+		if EqualValues(a, c) {
+			t.Errorf("EqualValues(%v, %v) is true", a, c)
+		}
+	}
+}
+
+func TestArrayKeyValues(t *testing.T) {
+	obj := func(k, v string) map[string]interface{} {
+		return map[string]interface{}{KeyOrder: []string{k}, k: v}
+	}
+	tests := []struct {
+		in     string
+		expect []interface{}
+	}{
+		{"x [ {a 1}, {b 2} ];\n", []interface{}{obj("a", "1"), obj("b", "2")}},
+		{"x [a=1, b=2];\n", []interface{}{obj("a", "1"), obj("b", "2")}},
+		{"x [a 1, b: 2, c];\n", []interface{}{obj("a", "1"), obj("b", "2"), "c"}},
+		{"x [a=1];\n", []interface{}{obj("a", "1")}},
+		{"x [a, 1];\n", []interface{}{"a", "1"}},
+		{"x [\"a\"=1, [b=2]];\n", []interface{}{obj("a", "1"),
+			[]interface{}{obj("b", "2")}}},
+	}
+	for _, test := range tests {
+		ucl, err := NewDecoder(bytes.NewBufferString(test.in + "y 1;\n")).Decode()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(ucl["x"], test.expect) {
+			t.Errorf("%q: got %v, expected %v", test.in, ucl["x"], test.expect)
+		}
+		if ucl["y"] != "1" {
+			t.Errorf("%q: lost the key after the array: %v", test.in, ucl)
+		}
+	}
+
+	// a value ending an object is not taken for the object's close
+	ucl, err := NewDecoder(bytes.NewBufferString("s { a b=1 }\nt 2\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetString(ucl, "s.a.b"); v != "1" || ucl["t"] != "2" {
+		t.Errorf("got %v", ucl)
+	}
+}
+
+func TestRequiredKeys(t *testing.T) {
+	s := "name web;\nserver { port 80; hosts [a, b]; }\ndebug;\n"
+	d := NewDecoder(bytes.NewBufferString(s))
+	d.SetRequiredKeys([]string{"name", "server.port", "server.hosts.1", "debug"})
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetRequiredKeys([]string{"name", "server.tls", "server.hosts.2", "user"})
+	_, err := d.Decode()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("got error %v, expected ValidationErrors", err)
+	}
+	expect := "missing required key server.tls; " +
+		"missing required key server.hosts.2; missing required key user"
+	if len(errs) != 3 || err.Error() != expect {
+		t.Errorf("got %q, expected %q", err, expect)
+	}
+
+	// schema errors come first
+	d = NewDecoder(bytes.NewBufferString(s))
+	d.SetSchema(map[string]interface{}{"required": []interface{}{"owner"}})
+	d.SetRequiredKeys([]string{"server.tls"})
+	_, err = d.Decode()
+	expect = "missing required key owner; missing required key server.tls"
+	if err == nil || err.Error() != expect {
+		t.Errorf("got %v, expected %q", err, expect)
+	}
+}
+
+func TestErrorModeCollectAll(t *testing.T) {
+	in := "a 1;\nb (x);\nc { d 1; d 2; e ); f 3; }\ng *nope;\nh 4;\n"
+	d := NewDecoder(bytes.NewBufferString(in))
+	d.SetErrorMode(CollectAll)
+	d.SetDuplicateKeyMode(DuplicateError)
+	d.SetAnchors(true)
+	ucl, err := d.Decode()
+	errs, ok := err.(DecodeErrors)
+	if !ok {
+		t.Fatalf("got error %v, expected DecodeErrors", err)
+	}
+	expect := []string{
+		"unexpected '(' at line 2, column 3; quote values that start with parentheses",
+		`duplicate key "d" at line 3, first defined at line 3`,
+		"unexpected ')' at line 3, column 17; quote values that start with parentheses",
+		"undefined alias *nope at line 4",
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("got %d errors, expected %d: %v", len(errs), len(expect), errs)
+	}
+	for i := range expect {
+		if errs[i].Error() != expect[i] {
+			t.Errorf("error %d: got %q, expected %q", i, errs[i], expect[i])
+		}
+	}
+	b, _ := json.Marshal(ucl)
+	if string(b) != `{"--ucl-keyorder--":["a","c","h"],"a":"1",`+
+		`"c":{"--ucl-keyorder--":["d","f"],"d":"1","f":"3"},"h":"4"}` {
+		t.Errorf("got %s", b)
+	}
+
+	// the end of the input still ends decoding
+	d = NewDecoder(bytes.NewBufferString("a { b (\nc 2\n"))
+	d.SetErrorMode(CollectAll)
+	_, err = d.Decode()
+	if errs, ok := err.(DecodeErrors); !ok || len(errs) != 2 ||
+		errs[1] != UnexpectedEOF {
+		t.Errorf("unclosed: got %v", err)
+	}
+
+	// by default decoding stops at the first error
+	_, err = NewDecoder(bytes.NewBufferString(in)).Decode()
+	if err == nil || err.Error() != expect[0] {
+		t.Errorf("stop: got %v", err)
+	}
+}
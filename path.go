@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Lookup of values in decoded UCL by path
+ */
+package ucl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Get returns the value at path in a decoded document v, such as the map
+// returned by Decode, and whether it exists. A path is a dotted list of
+// steps: object keys, and for arrays an element index, where negative
+// indices count from the end. So "servers.0.host" is the host of the first
+// server and "servers.-1.host" that of the last. An index out of range, or
+// one that is not an integer, is not found. The empty path is v itself.
+func Get(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, k := range strings.Split(path, ".") {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[k]; !ok || k == KeyOrder {
+				return nil, false
+			}
+		case *OrderedMap:
+			var ok bool
+			if v, ok = vv.Get(k); !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, ok := arrayindex(k, len(vv))
+			if !ok {
+				return nil, false
+			}
+			v = vv[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// GetString returns the scalar at path in a decoded document v as a string,
+// formatting typed values. It reports false if there is no such value or it
+// is an object, an array or null.
+func GetString(v interface{}, path string) (string, bool) {
+	v, ok := Get(v, path)
+	if !ok {
+		return "", false
+	}
+	switch vv := v.(type) {
+	case nil, map[string]interface{}, *OrderedMap, []interface{}:
+		return "", false
+	case string:
+		return vv, true
+	default:
+		return fmt.Sprint(vv), true
+	}
+}
+
+// arrayindex converts the path step k to an index into an array of n
+// elements, counting negative indices from the end
+func arrayindex(k string, n int) (int, bool) {
+	i, err := strconv.Atoi(k)
+	if err != nil {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
@@ -34,11 +34,16 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
+// TokenKind identifies the kind of a token, which is also the scanner
+// state that produced it.
+type TokenKind int
+
 const (
-	WHITESPACE = iota
+	WHITESPACE TokenKind = iota
 	TAG
 	SEMICOL  // semi-colon ;
 	COMMA    // ,
@@ -67,20 +72,78 @@ const (
 	MLSTRING_HEADER_OK
 )
 
+var tokenKindNames = [...]string{
+	WHITESPACE:         "WHITESPACE",
+	TAG:                "TAG",
+	SEMICOL:            "SEMICOL",
+	COMMA:              "COMMA",
+	COLON:              "COLON",
+	EQUAL:              "EQUAL",
+	QUOTE:              "QUOTE",
+	VQUOTE:             "VQUOTE",
+	SLASH:              "SLASH",
+	HCOMMENT:           "HCOMMENT",
+	LCOMMENT:           "LCOMMENT",
+	MLSTRING:           "MLSTRING",
+	BRACEOPEN:          "BRACEOPEN",
+	BRACECLOSE:         "BRACECLOSE",
+	BRACKETOPEN:        "BRACKETOPEN",
+	BRACKETCLOSE:       "BRACKETCLOSE",
+	LCOMMENT_CLOSING:   "LCOMMENT_CLOSING",
+	MAYBE_MLSTRING:     "MAYBE_MLSTRING",
+	MAYBE_MLSTRING2:    "MAYBE_MLSTRING2",
+	MLSTRING_PREP:      "MLSTRING_PREP",
+	MLSTRING_HEADER_OK: "MLSTRING_HEADER_OK",
+}
+
+func (k TokenKind) String() string {
+	if k >= 0 && int(k) < len(tokenKindNames) {
+		return tokenKindNames[k]
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
 const (
 	skip_white = 0x01
 	skip_sep   = 0x02
 )
 
+// flag of a SEMICOL standing in for the newline that ended a statement
+const eolsemi = 1
+
 type tag struct {
 	val   []byte
-	state int
+	state TokenKind
+	line  int // input line on which the tag starts
 
-	flag int // used by parser
+	// int32 keeps the tag in a small allocation size class
+	col  int32 // column on which the tag starts, 0 if unknown
+	flag int32 // used by parser
 }
 
 var UnexpectedEOF = errors.New("Unexpected EOF")
 
+// Trimming of the lines of multi-line strings
+//
+// A multi-line string runs from the line after "<<EOD" up to the first
+// line that is exactly "EOD", or "EOD" followed by ';'. A line holding
+// only backslashes followed by the delimiter, as in "\EOD" or "\\EOD", is
+// content and loses one backslash, so that the string can hold a line
+// "EOD". Lines merely containing the delimiter, such as "EODX" or " EOD",
+// are kept as written. Lines are trimmed after unescaping.
+const (
+	HeredocTrimNone              = iota
+	HeredocTrimLeadingWhitespace // strip the indentation of every line
+	HeredocTrimCommonIndent      // strip the indentation common to all lines
+)
+
+// Characters ending a bareword besides ';' and newline. A ',' only does so
+// within arrays and objects, or anywhere in JSON compatibility mode.
+const DefaultBarewordTerminators = ","
+
+// Number of completed input lines kept for SourceLine
+const keptLines = 32
+
 type scanner struct {
 	r      io.Reader
 	buf    []byte
@@ -89,31 +152,106 @@ type scanner struct {
 
 	depth []byte // current depth of scopes, e.g. [ '[', '{' ]
 	// to determine when the scope closes
-	curtag []byte
-	curch  byte
+	depthline []int // line on which each scope in depth was opened
+	curtag    []byte
+	curch     byte
+	lasttag   string // curtag as it was when the buffer was released
 
-	state   int
+	state   TokenKind
 	skipsep int
 
-	line int // current input line
+	line     int    // current input line
+	linebuf  []byte // input of the current line up to curch
+	tabwidth int    // columns a tab advances to a multiple of
+	mlcol    int    // column of the << of a multi-line string
+
+	kept     [keptLines][]byte // last completed lines, by line % keptLines
+	keptline int               // number of the last line in kept
+
+	tags []*tag // reused between calls of nexttags
+
+	nocopy bool   // tag values point into arena instead of being copied
+	arena  []byte // backing store of tag values when nocopy is set
 
 	mlstring_tag []byte // "EOD" tag of ML string
 	curline      []byte
 
+	hcommentsemi bool // # comment interrupted a statement
+	escnext      bool // a '\' ending the last read escapes the next byte
+
+	// state of inregex after the first rxscan bytes of curtag
+	rxscan int
+	rxopen bool
+	rxword bool
+
+	terminators string // characters other than ';' ending a bareword
+	jsoncompat  bool   // ',' also separates members at the top level
+	hcomments   string // characters beginning single-line comments
+	noblock     bool   // "/*" does not begin a comment
+
+	continuation bool // backslash before a newline continues the line
+	nlcontinues  bool // newline does not end a statement
+	contskip     bool // skipping indentation of a continuation line
+
+	heredoctrim int // HeredocTrim mode applied to multi-line strings
+
+	bytesread int64 // bytes read from r
+	maxdepth  int   // deepest nesting of scopes seen
+	progress  func(bytesread int64)
+
+	offsets map[*tag][2]int // byte spans of the tags of the last nexttags
+	mlstart int             // offset of the "<<" of a multiline string
+
 	err error
 }
 
+// Tag buffers are recycled between scanners; the contents of a tag buffer
+// are always copied out by maketag and never handed to the caller.
+var tagBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, 1024)
+	},
+}
+
 func newScanner(rio io.Reader) *scanner {
 	return &scanner{
 		r:      rio,
 		depth:  make([]byte, 0, 1024),
-		curtag: make([]byte, 0, 1024),
+		curtag: tagBufPool.Get().([]byte)[:0],
 		line:   1,
+
+		terminators: DefaultBarewordTerminators,
+		hcomments:   "#",
+	}
+}
+
+// release returns the tag buffer to the pool once scanning has ended
+func (s *scanner) release() {
+	if s.curtag != nil {
+		s.lasttag = string(s.curtag)
+		tagBufPool.Put(s.curtag[:0])
+		s.curtag = nil
 	}
 }
 
+// resync drops the token being read when scanning failed, so that scanning
+// can carry on after the offending byte
+func (s *scanner) resync() {
+	s.state = WHITESPACE
+	s.curtag = s.curtag[:0]
+	s.err = nil
+	s.escnext = false
+	s.contskip = false
+	s.skipsep = 0
+	s.rxscan = 0
+}
+
 func (s *scanner) scopeadd(c byte) {
 	s.depth = append(s.depth, c)
+	s.depthline = append(s.depthline, s.line)
+	if len(s.depth) > s.maxdepth {
+		s.maxdepth = len(s.depth)
+	}
 }
 
 func (s *scanner) scopereduce(c byte) bool {
@@ -122,6 +260,11 @@ func (s *scanner) scopereduce(c byte) bool {
 	}
 
 	found := false
+	defer func() {
+		if found {
+			s.depthline = s.depthline[:len(s.depthline)-1]
+		}
+	}()
 	switch s.depth[len(s.depth)-1] {
 	case '[':
 		if c == ']' {
@@ -134,14 +277,192 @@ func (s *scanner) scopereduce(c byte) bool {
 			s.depth = s.depth[:len(s.depth)-1]
 			found = true
 		}
+	}
+	return found
+}
 
-	case '(':
-		if c == ')' {
-			s.depth = s.depth[:len(s.depth)-1]
-			found = true
+// A BracketError reports a closing bracket that does not match the
+// innermost open scope.
+type BracketError struct {
+	Char     byte // the closing bracket found
+	Line     int
+	Col      int
+	Open     byte // the innermost open bracket, 0 if none
+	OpenLine int  // line on which Open was found
+}
+
+var bracketNames = map[byte]string{'{': "object", '[': "array"}
+var bracketPairs = map[byte]byte{'{': '}', '[': ']'}
+
+func (e *BracketError) Error() string {
+	if e.Open == 0 {
+		return fmt.Sprintf("unexpected '%c' at line %d, column %d; nothing to close",
+			e.Char, e.Line, e.Col)
+	}
+	return fmt.Sprintf("unexpected '%c' at line %d, column %d; expected '%c' to close %s opened at line %d",
+		e.Char, e.Line, e.Col, bracketPairs[e.Open], bracketNames[e.Open],
+		e.OpenLine)
+}
+
+// closeerror describes closing bracket c not matching the current scope
+func (s *scanner) closeerror(c byte) error {
+	e := &BracketError{Char: c, Line: s.line, Col: s.curcol()}
+	if n := len(s.depth); n > 0 {
+		e.Open = s.depth[n-1]
+		e.OpenLine = s.depthline[n-1]
+	}
+	return e
+}
+
+// isspace reports whether c is whitespace: space, tab, newline, vertical
+// tab, form feed or carriage return. Other control characters are only
+// allowed within quoted strings, multi-line strings and comments.
+func isspace(c byte) bool {
+	return c == ' ' || c >= '\t' && c <= '\r'
+}
+
+// unquoted reports whether the scanner is outside quoted strings,
+// multi-line strings and comments
+func (s *scanner) unquoted() bool {
+	switch s.state {
+	case QUOTE, VQUOTE, HCOMMENT, LCOMMENT, LCOMMENT_CLOSING, MLSTRING,
+		MLSTRING_HEADER_OK:
+		return false
+	}
+	return true
+}
+
+// isterm reports whether c terminates a bareword value
+func (s *scanner) isterm(c byte) bool {
+	return strings.IndexByte(s.terminators, c) >= 0
+}
+
+// septype is the kind of separator emitted for terminator c: a COMMA for
+// ',' and within arrays, otherwise a SEMICOL ending the statement
+func (s *scanner) septype(c byte) TokenKind {
+	if c == ',' || s.curdepth() == '[' {
+		return COMMA
+	}
+	return SEMICOL
+}
+
+// ishcomment reports whether c begins a single-line comment
+func (s *scanner) ishcomment(c byte) bool {
+	return strings.IndexByte(s.hcomments, c) >= 0
+}
+
+// commentstart reports whether c, read in the TAG state, begins a "#" or
+// "/*" comment; comments must be separated from the tag by whitespace,
+// except those beginning with ';', which cannot be part of a tag
+func (s *scanner) commentstart(c byte) bool {
+	n := len(s.curtag)
+	switch {
+	case s.ishcomment(c):
+		return c == ';' || n == 0 || s.curtag[n-1] <= ' '
+	case c == '*' && !s.noblock:
+		return n > 0 && s.curtag[n-1] == '/' &&
+			(n == 1 || s.curtag[n-2] <= ' ')
+	}
+	return false
+}
+
+// wordstart reports whether the last n bytes of curtag begin a word, i.e.
+// follow whitespace or the '=' or ':' between a key and its value
+func (s *scanner) wordstart(n int) bool {
+	i := len(s.curtag) - n - 1
+	return i < 0 || s.curtag[i] <= ' ' || s.curtag[i] == '=' ||
+		s.curtag[i] == ':'
+}
+
+// heredocerror reports the non-whitespace c following the tag of a heredoc
+// header
+func (s *scanner) heredocerror(c byte) error {
+	return fmt.Errorf("heredoc tag %q at line %d must be an identifier "+
+		"followed by a newline, found '%c'", s.mlstring_tag, s.line, c)
+}
+
+// inregex reports whether the word being read in curtag is an open regex:
+// it starts with '/' and has no other unescaped '/' yet. It carries on from
+// the bytes scanned by the previous call, until the tag ends, so that long
+// values are scanned in linear time.
+func (s *scanner) inregex() bool {
+	if s.rxscan == 0 || s.rxscan > len(s.curtag) {
+		s.rxscan, s.rxopen, s.rxword = 0, false, true
+	}
+	for ; s.rxscan < len(s.curtag); s.rxscan++ {
+		c := s.curtag[s.rxscan]
+		switch {
+		case s.rxopen && c == '\\':
+			s.rxscan++
+		case c <= ' ':
+			s.rxopen, s.rxword = false, true
+		case s.rxopen && c == '/':
+			s.rxopen = false
+		case s.rxword:
+			s.rxopen, s.rxword = c == '/', false
 		}
 	}
-	return found
+	return s.rxopen
+}
+
+// escaped adds the backslash c and the byte it escapes to curtag; a byte
+// not read yet is added by the next scan
+func (s *scanner) escaped(c byte) {
+	s.curtag = append(s.curtag, c)
+	if s.bufi < s.bufmax {
+		c = s.buf[s.bufi]
+		s.bufi++
+		s.curtag = append(s.curtag, c)
+		s.linebuf = append(s.linebuf, c)
+		if c == '\n' {
+			s.line++
+		}
+	} else {
+		s.escnext = true
+	}
+}
+
+// keep stores the lines of b, the last of which is line number last, among
+// the recently read lines
+func (s *scanner) keep(b []byte, last int) {
+	n := last - bytes.Count(b, []byte{'\n'})
+	for ; n <= last; n++ {
+		l := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			l, b = b[:i], b[i+1:]
+		}
+		s.kept[n%keptLines] = append(s.kept[n%keptLines][:0], l...)
+	}
+	s.keptline = last
+}
+
+// sourceline returns input line n if it is the current line, as far as it
+// was read, or among the kept lines
+func (s *scanner) sourceline(n int) (string, bool) {
+	// linebuf may hold escaped newlines
+	lines := bytes.Split(s.linebuf, []byte{'\n'})
+	first := s.line - len(lines) + 1
+	var l []byte
+	switch {
+	case n >= first && n <= s.line:
+		l = lines[n-first]
+	case n >= 1 && n <= s.keptline && n > s.keptline-keptLines:
+		l = s.kept[n%keptLines]
+	default:
+		return "", false
+	}
+	return string(bytes.TrimSuffix(l, []byte{'\r'})), true
+}
+
+// trimmedtag makes a TAG of curtag without trailing whitespace, or returns
+// nil if curtag is blank
+func (s *scanner) trimmedtag() *tag {
+	for i := len(s.curtag) - 1; i >= 0; i-- {
+		if s.curtag[i] > ' ' {
+			return s.maketag(s.curtag[0:i+1], TAG)
+		}
+	}
+	return nil
 }
 
 func (s *scanner) curdepth() byte {
@@ -151,20 +472,145 @@ func (s *scanner) curdepth() byte {
 	return s.depth[len(s.depth)-1]
 }
 
+// unreadbyte steps back over c, the byte just read, to scan it again
+func (s *scanner) unreadbyte(c byte) {
+	s.bufi--
+	s.linebuf = s.linebuf[:len(s.linebuf)-1]
+	if c == '\n' {
+		s.line--
+	}
+}
+
 func (s *scanner) discard() {
-	s.curtag = make([]byte, 0, 1024)
+	s.curtag = s.curtag[:0]
+	s.rxscan = 0
 }
 
-func (s *scanner) maketag(v []byte, state int) (t *tag) {
+// column returns the column of byte off of the current line, counting from
+// 1 and expanding tabs if a tab width is set
+func (s *scanner) column(off int) int {
+	if s.tabwidth <= 1 {
+		return off + 1
+	}
+	col := 0
+	for _, c := range s.linebuf[:off] {
+		if c == '\t' && s.tabwidth > 1 {
+			col += s.tabwidth - col%s.tabwidth
+		} else {
+			col++
+		}
+	}
+	return col + 1
+}
+
+// curcol returns the column of the current character
+func (s *scanner) curcol() int {
+	return s.column(len(s.linebuf) - 1)
+}
+
+// column on which a tag whose raw text is v started, 0 if it is not known
+// because the tag spans lines
+func (s *scanner) tagcol(v []byte, state TokenKind) int {
+	switch state {
+	case MLSTRING:
+		return s.mlcol
+	case QUOTE, VQUOTE:
+		// closed by the current character
+		off := len(s.linebuf) - len(v) - 2
+		if off < 0 || bytes.IndexByte(v, '\n') >= 0 {
+			return 0
+		}
+		return s.column(off)
+	case TAG, SLASH, HCOMMENT, LCOMMENT, WHITESPACE:
+		if bytes.IndexByte(v, '\n') >= 0 {
+			return 0
+		}
+		// usually ended by the current character
+		n := len(s.linebuf) - 1
+		if n >= 0 && bytes.HasSuffix(s.linebuf[:n], v) {
+			return s.column(n - len(v))
+		}
+		if i := bytes.LastIndex(s.linebuf, v); i >= 0 {
+			return s.column(i)
+		}
+		return 0
+	}
+	// punctuation is the current character
+	return s.curcol()
+}
+
+// fieldtags appends a TAG for each space separated word of curtag
+func (s *scanner) fieldtags(tags []*tag) []*tag {
+	start := bytes.LastIndex(s.linebuf, s.curtag)
+	off := 0
+	for _, f := range strings.Split(string(s.curtag), " ") {
+		if f != "" {
+			t := s.maketag([]byte(f), TAG)
+			t.col = 0
+			if start >= 0 {
+				t.col = int32(s.column(start + off))
+			}
+			tags = append(tags, t)
+		}
+		off += len(f) + 1
+	}
+	return tags
+}
+
+// line on which a tag whose raw text is v started
+func (s *scanner) tagline(v []byte, state TokenKind) int {
+	line := s.line - bytes.Count(v, []byte{'\n'})
+	if s.curch == '\n' {
+		// the terminating newline was already counted
+		line--
+	}
+	if state == MLSTRING {
+		// content starts after the <<EOD header and ends before EOD,
+		// on the same line if empty
+		line -= 2
+		if len(v) == 0 {
+			line++
+		}
+	}
+	return line
+}
+
+// eoltag returns the SEMICOL ending a statement at a newline
+func (s *scanner) eoltag() *tag {
+	t := s.maketag([]byte(";"), SEMICOL)
+	t.flag = eolsemi
+	return t
+}
+
+// tagval copies v to be used as a tag's value. In nocopy mode the value is
+// kept in the arena, which is overwritten by the next call of nexttags.
+func (s *scanner) tagval(v []byte) []byte {
+	if !s.nocopy {
+		val := make([]byte, len(v))
+		copy(val, v)
+		return val
+	}
+	n := len(s.arena)
+	s.arena = append(s.arena, v...)
+	return s.arena[n:len(s.arena):len(s.arena)]
+}
+
+func (s *scanner) maketag(v []byte, state TokenKind) (t *tag) {
 	t = new(tag)
+	s.rxscan = 0
 	if v != nil {
 		if len(v) > 0 {
-			t.val = make([]byte, len(v))
-			copy(t.val, v)
+			t.val = s.tagval(v)
 			t.state = state
+			t.line = s.tagline(v, state)
+			t.col = int32(s.tagcol(v, state))
+			s.trackspan(t, v, state)
 		}
 	} else if s.state == QUOTE || s.state == VQUOTE {
 		t.state = s.state
+		t.line = s.tagline(s.curtag, s.state)
+		t.col = int32(s.tagcol(s.curtag, s.state))
+		s.trackspan(t, s.curtag, s.state)
 		var c byte
 		if s.state == QUOTE {
 			c = '"'
@@ -177,36 +623,188 @@ func (s *scanner) maketag(v []byte, state int) (t *tag) {
 				string(s.curtag), s.line)
 			return nil
 		}
-		t.val = []byte(qs)
+		t.val = s.tagval([]byte(qs))
 		s.curtag = s.curtag[:0]
-	} else if len(s.curtag) > 0 {
+	} else if len(s.curtag) > 0 || s.state == MLSTRING {
 		t.state = s.state
-		t.val = s.curtag
-		s.curtag = make([]byte, 0, 1024)
+		t.line = s.tagline(s.curtag, s.state)
+		t.col = int32(s.tagcol(s.curtag, s.state))
+		t.val = s.tagval(s.curtag)
+		s.trackspan(t, s.curtag, s.state)
+		s.curtag = s.curtag[:0]
 	}
 	return t
 }
 
-func (s *scanner) nexttags() (tags []*tag, err error) {
-	err = nil
+// trackspan records the byte offsets at which t, whose raw text is v,
+// starts and ends if offsets are tracked
+func (s *scanner) trackspan(t *tag, v []byte, state TokenKind) {
+	if s.offsets == nil {
+		return
+	}
+	// offset past the current character, and of the start of its line
+	cur := int(s.bytesread) - (s.bufmax - s.bufi)
+	line := cur - len(s.linebuf)
+
+	var span [2]int
+	switch state {
+	case MLSTRING:
+		// from "<<" to the end of the closing "EOD"
+		span = [2]int{s.mlstart, cur - 1}
+	case QUOTE, VQUOTE:
+		// closed by the current character
+		span = [2]int{cur - len(v) - 2, cur}
+	case TAG, SLASH, HCOMMENT, LCOMMENT, WHITESPACE:
+		// usually ended by the current character
+		end := cur - 1
+		n := len(s.linebuf) - 1
+		if n < 0 || !bytes.HasSuffix(s.linebuf[:n], v) {
+			if i := bytes.LastIndex(s.linebuf, v); i >= 0 {
+				end = line + i + len(v)
+			}
+		}
+		span = [2]int{end - len(v), end}
+	default:
+		// punctuation is the current character
+		span = [2]int{cur - 1, cur}
+	}
+	s.offsets[t] = span
+}
+
+// unterminated reports whether input ending now would cut off a string or
+// a comment
+func (s *scanner) unterminated() bool {
+	switch s.state {
+	case QUOTE, VQUOTE, LCOMMENT, LCOMMENT_CLOSING, MLSTRING:
+		return true
+	}
+	return false
+}
+
+// heredocend reports whether the line read so far of a multi-line string
+// is its delimiter tag, ending it
+func (s *scanner) heredocend() bool {
+	linestart := len(s.curtag) == 0 || s.curtag[len(s.curtag)-1] == '\n'
+	return linestart && bytes.Equal(s.curline, s.mlstring_tag)
+}
+
+// escapedtag reports whether line, beginning a line of a multi-line string,
+// is its delimiter tag preceded by backslashes, one of which is dropped
+func escapedtag(line, tag []byte) bool {
+	n := len(line) - len(tag)
+	return n > 0 && bytes.HasSuffix(line, tag) &&
+		len(bytes.TrimLeft(line[:n], "\\")) == 0
+}
+
+// dedent removes the leading whitespace common to all lines of b, ignoring
+// lines holding only whitespace, which become empty
+func dedent(b []byte) []byte {
+	lines := bytes.Split(b, []byte{'\n'})
+	var prefix []byte
+	first := true
+	for _, l := range lines {
+		ws := l[:len(l)-len(bytes.TrimLeft(l, " \t"))]
+		if len(ws) == len(l) {
+			continue
+		}
+		if first {
+			prefix, first = ws, false
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(ws) && prefix[n] == ws[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	for i, l := range lines {
+		if len(bytes.TrimLeft(l, " \t")) == 0 {
+			lines[i] = l[:0]
+		} else {
+			lines[i] = l[len(prefix):]
+		}
+	}
+	return bytes.Join(lines, []byte{'\n'})
+}
+
+// nexttags returns the next group of tags. The returned slice is reused by
+// the following call, but the tags it points to are not.
+func (s *scanner) nexttags() ([]*tag, error) {
+	if s.tags == nil {
+		s.tags = make([]*tag, 0, 32)
+	}
+	for i := range s.tags {
+		s.tags[i] = nil
+	}
+	s.arena = s.arena[:0]
+	if s.offsets != nil {
+		for t := range s.offsets {
+			delete(s.offsets, t)
+		}
+	}
+
+	tags, err := s.scan(s.tags[:0])
+	if tags != nil {
+		s.tags = tags
+	}
+	if err != nil {
+		s.release()
+	}
+	return tags, err
+}
+
+// eoftags completes tags with the statement left open at the end of the
+// input, as if it ended with a newline
+func (s *scanner) eoftags(tags []*tag) []*tag {
+	open := len(tags) > 0
+	switch s.state {
+	case TAG:
+		if t := s.trimmedtag(); t != nil {
+			tags = append(tags, t)
+			open = true
+		}
+	case HCOMMENT:
+		tags = append(tags, s.maketag(nil, 0))
+		open = open || s.hcommentsemi
+		s.hcommentsemi = false
+	}
+	if open {
+		tags = append(tags, s.maketag([]byte(";"), SEMICOL))
+	}
+	s.curtag = s.curtag[:0]
+	s.state = WHITESPACE
+	return tags
+}
 
+func (s *scanner) scan(tags []*tag) (_ []*tag, err error) {
 	if s.buf == nil {
 		s.buf = make([]byte, 4096)
 	}
 
-	tags = make([]*tag, 0, 32)
 	for {
 		if s.bufi >= s.bufmax {
 			s.bufmax, err = s.r.Read(s.buf)
+			s.bytesread += int64(s.bufmax)
+			if s.progress != nil && s.bufmax > 0 {
+				s.progress(s.bytesread)
+			}
+			if s.bufmax == 0 && s.state == MLSTRING && s.heredocend() {
+				// "EOD" ending the input, as if followed by a newline
+				s.buf[0], s.bufmax = '\n', 1
+			}
 			if s.bufmax == 0 {
-				if len(s.depth) > 0 {
+				s.bufi = 0
+				if len(s.depth) > 0 || s.unterminated() {
 					return nil, UnexpectedEOF
+				} else if tags = s.eoftags(tags); len(tags) > 0 {
+					return tags, nil
 				} else {
 					return nil, io.EOF
 				}
 			}
 
-			if err != nil {
+			// readers may return io.EOF along with the last data
+			if err != nil && err != io.EOF {
 				return nil, err
 			}
 
@@ -215,11 +813,33 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 		c := s.buf[s.bufi]
 		s.bufi++
+		s.curch = c
+
+		if n := len(s.linebuf); n > 0 && s.linebuf[n-1] == '\n' {
+			s.keep(s.linebuf[:n-1], s.line-1)
+			s.linebuf = s.linebuf[:0]
+		}
+		s.linebuf = append(s.linebuf, c)
 
 		if c == '\n' {
 			s.line++
 		}
 
+		if s.escnext {
+			s.escnext = false
+			s.curtag = append(s.curtag, c)
+			if c == '\n' && s.continuation &&
+				(s.state == QUOTE || s.state == VQUOTE) {
+				s.curtag = s.curtag[:len(s.curtag)-2]
+			}
+			continue
+		}
+
+		if c < ' ' && !isspace(c) && s.unquoted() {
+			return nil, fmt.Errorf("unexpected control character %#02x at "+
+				"line %d, column %d", c, s.line, s.curcol())
+		}
+
 		switch s.state {
 		case WHITESPACE, BRACEOPEN, BRACECLOSE:
 
@@ -249,6 +869,24 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				*/
 			}
 
+			if s.ishcomment(c) {
+				s.curtag = append(s.curtag, c)
+				s.state = HCOMMENT
+				break
+			}
+
+			if c != ',' && s.isterm(c) {
+				// custom terminator as a separator of its own
+				s.curtag = append(s.curtag[:0], c)
+				s.state = s.septype(c)
+				tags = append(tags, s.maketag(nil, 0))
+				if s.err != nil {
+					return nil, s.err
+				}
+				s.state = WHITESPACE
+				return tags, nil
+			}
+
 			if c != '"' && c != '\'' {
 				s.curtag = append(s.curtag, c)
 			}
@@ -259,7 +897,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.state = BRACKETOPEN
 				} else {
 					if !s.scopereduce(c) {
-						return nil, fmt.Errorf("misplaced ] at line %d", s.line)
+						return nil, s.closeerror(c)
 					}
 					s.state = BRACKETCLOSE
 				}
@@ -271,13 +909,12 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				s.state = WHITESPACE
 				return tags, nil
 
-			case '(':
-				s.state = TAG
-				s.skipsep = skip_white | skip_sep
-
-			case ')':
-				s.state = TAG
-				s.skipsep = skip_white | skip_sep
+			case '(', ')':
+				// parenthesized groups are not part of the grammar;
+				// parentheses are only allowed inside barewords
+				return nil, fmt.Errorf("unexpected '%c' at line %d, column %d; "+
+					"quote values that start with parentheses", c, s.line,
+					s.curcol())
 
 			case '{', '}':
 				if c == '{' {
@@ -285,7 +922,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.state = BRACEOPEN
 				} else {
 					if !s.scopereduce(c) {
-						return nil, fmt.Errorf("misplaced } at line %d", s.line)
+						return nil, s.closeerror(c)
 					}
 					s.state = BRACECLOSE
 				}
@@ -305,9 +942,6 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			case '\'':
 				s.state = VQUOTE
 
-			case '#':
-				s.state = HCOMMENT
-
 			case '<':
 				s.state = TAG
 				s.skipsep = skip_white | skip_sep
@@ -316,13 +950,18 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				if len(tags) == 0 ||
 					(tags[len(tags)-1].state != QUOTE &&
 						tags[len(tags)-1].state != VQUOTE) {
-					return nil, fmt.Errorf("unexpected '%c' at line %d", c, s.line)
+					return nil, fmt.Errorf("unexpected '%c' at line %d, column %d",
+						c, s.line, s.curcol())
 				}
 				s.state = TAG
 				s.skipsep = skip_white
 
 			case ',':
-				if s.curdepth() == '[' {
+				if !s.isterm(c) {
+					// part of a bareword
+					s.state = TAG
+					s.skipsep = skip_white | skip_sep
+				} else if s.curdepth() != 0 || s.jsoncompat {
 					s.state = COMMA
 					tags = append(tags, s.maketag(nil, 0))
 					if s.err != nil {
@@ -331,7 +970,8 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.state = WHITESPACE
 					return tags, nil
 				} else {
-					return nil, fmt.Errorf("unexpected ',' at line %d", s.line)
+					return nil, fmt.Errorf("unexpected ',' at line %d, column %d",
+						s.line, s.curcol())
 				}
 
 			case ';':
@@ -353,27 +993,79 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			// read until either ; { or '\n'
 			// if {, then split tag into different keys and send each tag
 			// as a TAG
-			if len(s.curtag) > 0 {
-				if s.curtag[len(s.curtag)-1] == '<' {
-					// possibly multiline string if next character
-					// is alphanum
-					s.curtag = append(s.curtag, c)
-					s.state = MAYBE_MLSTRING
+			if s.contskip {
+				if c == ' ' || c == '\t' || c == '\r' {
 					break
 				}
+				s.contskip = false
+				if len(s.curtag) > 0 && c != '\n' && c != ';' &&
+					c != '}' && c != ']' && !s.isterm(c) {
+					s.curtag = append(s.curtag, ' ')
+				}
+			}
+			if s.continuation && c != '\n' &&
+				bytes.HasSuffix(s.curtag, []byte{'\\'}) {
+				return nil, fmt.Errorf("unexpected '\\' at line %d, column %d",
+					s.line, s.curcol()-1)
+			}
+
+			if c == '<' && bytes.HasSuffix(s.curtag, []byte{'<'}) &&
+				!bytes.HasSuffix(s.curtag, []byte("<<")) && s.wordstart(1) {
+				// "<<" starting a word: multiline string if the next
+				// character is alphanum
+				s.curtag = append(s.curtag, c)
+				s.state = MAYBE_MLSTRING
+				s.mlstart = int(s.bytesread) - (s.bufmax - s.bufi) - 2
+				break
+			}
+
+			if s.commentstart(c) {
+				// comment following a tag: terminate the tag first
+				if c == '*' {
+					s.curtag = s.curtag[:len(s.curtag)-1]
+				}
+				if t := s.trimmedtag(); t != nil {
+					tags = append(tags, t)
+				}
+				s.curtag = s.curtag[:0]
+				if c != '*' {
+					s.curtag = append(s.curtag, c)
+					s.state = HCOMMENT
+					// the newline ending the comment ends the statement
+					s.hcommentsemi = !s.nlcontinues
+				} else {
+					s.curtag = append(s.curtag, '/', c)
+					s.state = LCOMMENT
+				}
+				if s.err != nil {
+					return nil, s.err
+				}
+				break
+			}
+
+			if c > ' ' && c != ';' && !s.isterm(c) && s.inregex() {
+				// within a regex only '\' and the closing '/' are special
+				if c == '\\' {
+					s.escaped(c)
+				} else {
+					s.curtag = append(s.curtag, c)
+				}
+				if len(tags) > 0 {
+					s.skipsep &= ^skip_white
+				}
+				break
+			}
+
+			if (c == '(' || c == ')') && (len(s.curtag) == 0 ||
+				s.curtag[len(s.curtag)-1] <= ' ') {
+				return nil, fmt.Errorf("unexpected '%c' at line %d, column %d; "+
+					"quote values that start with parentheses", c, s.line,
+					s.curcol())
 			}
 
 			if c == '{' {
 				// split up tag into individual strings, separated by ' '
-				fields := strings.Split(string(s.curtag), " ")
-				for f := range fields {
-					if fields[f] != "" {
-						tags = append(tags, s.maketag([]byte(fields[f]), TAG))
-						if s.err != nil {
-							return nil, s.err
-						}
-					}
-				}
+				tags = s.fieldtags(tags)
 				s.curtag = s.curtag[:0]
 				s.curtag = append(s.curtag, c)
 				s.scopeadd(c)
@@ -387,7 +1079,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 			} else if c == '}' {
 				if s.curdepth() != '{' {
-					return nil, fmt.Errorf("unexpected } at line %d", s.line)
+					return nil, s.closeerror(c)
 				}
 
 				// scan backwards and terminate previous tag
@@ -432,15 +1124,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 			} else if c == '[' {
 				// split up tag into individual strings, separated by ' '
-				fields := strings.Split(string(s.curtag), " ")
-				for f := range fields {
-					if fields[f] != "" {
-						tags = append(tags, s.maketag([]byte(fields[f]), TAG))
-						if s.err != nil {
-							return nil, s.err
-						}
-					}
-				}
+				tags = s.fieldtags(tags)
 				s.curtag = s.curtag[:0]
 				s.curtag = append(s.curtag, c)
 				s.scopeadd(c)
@@ -454,7 +1138,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 			} else if c == ']' {
 				if s.curdepth() != '[' {
-					return nil, fmt.Errorf("unexpected } at line %d", s.line)
+					return nil, s.closeerror(c)
 				}
 
 				// scan backwards and terminate previous tag
@@ -480,6 +1164,10 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 			} else if c == ';' {
 				// Terminate
+				if s.nlcontinues {
+					// drop the newlines before the ';'
+					s.curtag = bytes.TrimRight(s.curtag, " \t\r\n")
+				}
 				tags = append(tags, s.maketag(nil, 0))
 				if s.err != nil {
 					return nil, s.err
@@ -494,18 +1182,20 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				s.state = WHITESPACE
 				return tags, nil
 
-			} else if c == ',' {
-				if s.curdepth() != '[' && s.curdepth() != '{' {
+			} else if s.isterm(c) {
+				if c == ',' && s.curdepth() == 0 && !s.jsoncompat {
 					s.curtag = append(s.curtag, c)
 					break
 				}
-				tags = append(tags, s.maketag(nil, 0))
+				if t := s.trimmedtag(); t != nil {
+					tags = append(tags, t)
+				}
 				if s.err != nil {
 					return nil, s.err
 				}
 				s.curtag = s.curtag[:0]
 				s.curtag = append(s.curtag, c)
-				s.state = COMMA
+				s.state = s.septype(c)
 				tags = append(tags, s.maketag(nil, 0))
 				if s.err != nil {
 					return nil, s.err
@@ -513,17 +1203,19 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				s.state = WHITESPACE
 				return tags, nil
 
-			} else if c == '\n' {
-				// TODO: option for semicolon forced termination
-				//s.curtag = append(s.curtag, ' ')
+			} else if c == '\n' && s.continuation &&
+				bytes.HasSuffix(s.curtag, []byte{'\\'}) {
+				// join with the next line, separated by a single space
+				s.curtag = bytes.TrimRight(s.curtag[:len(s.curtag)-1], " \t")
+				s.contskip = true
+				s.rxscan = 0
+
+			} else if c == '\n' && !s.nlcontinues {
 				tags = append(tags, s.maketag(nil, 0))
 				if s.err != nil {
 					return nil, s.err
 				}
-				tags = append(tags, s.maketag([]byte(";"), SEMICOL))
-				if s.err != nil {
-					return nil, s.err
-				}
+				tags = append(tags, s.eoltag())
 				s.state = WHITESPACE
 				s.curtag = s.curtag[:0]
 				return tags, nil
@@ -565,8 +1257,14 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				}
 
 			} else if c == '\\' {
-				return nil, fmt.Errorf("unexpected '%c' at line %d", c,
-					s.line)
+				if s.continuation && (s.bufi >= s.bufmax ||
+					s.buf[s.bufi] == '\n') {
+					// checked by the next character if not yet read
+					s.curtag = append(s.curtag, c)
+					break
+				}
+				return nil, fmt.Errorf("unexpected '%c' at line %d, column %d",
+					c, s.line, s.curcol())
 
 			} else {
 				s.curtag = append(s.curtag, c)
@@ -576,14 +1274,15 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			}
 
 		case MAYBE_MLSTRING:
-			s.curtag = append(s.curtag, c)
 			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
 				c >= '0' && c <= '9' {
+				s.curtag = append(s.curtag, c)
 				s.state = MLSTRING_PREP
-				s.curline = make([]byte, 0, 128)
-				s.curline = append(s.curline, c)
+				s.curline = append(s.curline[:0], c)
 			} else {
+				// a literal "<<"; read c again as part of the tag
 				s.state = TAG
+				s.unreadbyte(c)
 			}
 
 		case MLSTRING_PREP:
@@ -605,7 +1304,10 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 							break
 						}
 						if s.curtag[te] > ' ' && s.curtag[te] != '=' {
-							return nil, fmt.Errorf("Line %d %c %d %s", s.line, s.curtag[te], te, string(s.curtag))
+							head := s.curtag[:bytes.IndexByte(s.curtag, '<')]
+							return nil, fmt.Errorf("heredoc at line %d must "+
+								"directly follow a single key, not %q", s.line,
+								bytes.TrimSpace(head))
 						}
 					}
 					tags = append(tags, s.maketag(s.curtag[:ti], TAG))
@@ -627,13 +1329,19 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				// end of "EOD" tag
 				s.mlstring_tag = make([]byte, len(s.curline))
 				copy(s.mlstring_tag, s.curline)
-				s.curline = nil
+				s.mlcol = 0
+				if i := bytes.LastIndex(s.linebuf, []byte("<<")); i >= 0 {
+					s.mlcol = s.column(i)
+				}
+				s.curline = s.curline[:0]
 				s.curtag = s.curtag[:0]
 				if c == '\n' {
 					s.state = MLSTRING
-				} else {
-					// discard junk after "EOD"
+				} else if isspace(c) {
+					// skip whitespace after "EOD"
 					s.state = MLSTRING_HEADER_OK
+				} else {
+					return nil, s.heredocerror(c)
 				}
 			}
 
@@ -641,27 +1349,42 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			// read and skip to eol
 			if c == '\n' {
 				s.state = MLSTRING
+			} else if !isspace(c) {
+				return nil, s.heredocerror(c)
 			}
 
 		case MLSTRING:
-			// read until we see "EOD" on its own line
-			if s.curline == nil {
-				s.curline = make([]byte, 0, 128)
-			}
+			// read until we see "EOD" on its own line; curline is reused
+			// for every line
 			if c == ';' || c == '\n' {
-				if bytes.Equal(s.curline, s.mlstring_tag) {
+				linestart := len(s.curtag) == 0 ||
+					s.curtag[len(s.curtag)-1] == '\n'
+				if s.heredocend() {
 					// "EOD" reached
-					s.curtag = s.curtag[:len(s.curtag)-1]
+					if len(s.curtag) > 0 {
+						s.curtag = s.curtag[:len(s.curtag)-1]
+					}
+					if s.heredoctrim == HeredocTrimCommonIndent {
+						s.curtag = dedent(s.curtag)
+					}
 					tags = append(tags, s.maketag(nil, 0))
 					if s.err != nil {
 						return nil, s.err
 					}
 					s.state = WHITESPACE
 				} else {
-					s.curtag = append(s.curtag, s.curline...)
+					line := s.curline
+					if linestart && escapedtag(line, s.mlstring_tag) {
+						// "\EOD" stands for a line "EOD"
+						line = line[1:]
+					}
+					if s.heredoctrim == HeredocTrimLeadingWhitespace && linestart {
+						line = bytes.TrimLeft(line, " \t")
+					}
+					s.curtag = append(s.curtag, line...)
 					s.curtag = append(s.curtag, c)
 				}
-				s.curline = nil
+				s.curline = s.curline[:0]
 			} else {
 				s.curline = append(s.curline, c)
 			}
@@ -674,18 +1397,27 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			if c == '\\' {
 				if s.bufi >= s.bufmax {
 					s.curtag = append(s.curtag, c)
+					s.escnext = true
 					break
 				}
 				s.curtag = append(s.curtag, c)
 				c = s.buf[s.bufi]
 				s.curtag = append(s.curtag, c)
+				s.linebuf = append(s.linebuf, c)
 				if c == '\n' {
 					s.line++
+					if s.continuation {
+						// continued string, drop backslash and newline
+						s.curtag = s.curtag[:len(s.curtag)-2]
+					}
 				}
 				s.bufi++
 
 			} else if (s.state == QUOTE && c == '"') ||
 				(s.state == VQUOTE && c == '\'') {
+				// the closing quote always ends the token: whatever
+				// follows starts a new one, as if after whitespace, so
+				// "key"value is the same as "key" value
 				tags = append(tags, s.maketag(nil, 0))
 				if s.err != nil {
 					return nil, s.err
@@ -700,19 +1432,13 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			// read until next slash or whitespace. regex with whitespace
 			// have an outer quote
 
-			if len(s.curtag) == 1 && c == '*' {
+			if len(s.curtag) == 1 && c == '*' && !s.noblock {
 				s.curtag = append(s.curtag, c)
 				s.state = LCOMMENT
 			} else {
 				if c == '\\' {
-					// Escape sequence
-					if s.bufi+1 < s.bufmax {
-						s.curtag = append(s.curtag, c)
-						s.bufi++
-						s.curtag = append(s.curtag, s.buf[s.bufi])
-						s.bufi++
-						break
-					}
+					s.escaped(c)
+					break
 				}
 
 				switch c {
@@ -764,6 +1490,10 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				if s.err != nil {
 					return nil, s.err
 				}
+				if s.hcommentsemi {
+					tags = append(tags, s.eoltag())
+					s.hcommentsemi = false
+				}
 				s.state = WHITESPACE
 				return tags, nil
 			} else {
@@ -793,8 +1523,94 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 	}
 }
 
-func (s *scanner) LatestTag() (string, int) {
-	return string(s.curtag), s.state
+// A Token is a single lexical element of UCL input
+type Token struct {
+	Value []byte
+	Kind  TokenKind
+	Line  int
+	Col   int // column of the token's start, 0 if it spans lines
+}
+
+// A Scanner reads UCL input token by token.
+type Scanner struct {
+	s     *scanner
+	tags  []*tag
+	tagsi int
+}
+
+// NewScanner returns a scanner reading from r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{s: newScanner(r)}
+}
+
+// SetZeroCopy controls whether token values are copied. When enabled, the
+// Value of a token returned by Next points into a buffer owned by the
+// scanner and is only valid until the next call to Next, like
+// bufio.Scanner.Bytes; callers must copy it to keep it.
+func (sc *Scanner) SetZeroCopy(on bool) {
+	sc.s.nocopy = on
+}
+
+// LatestTag returns the partial token the scanner was reading, its kind and
+// the current line. It is meant for diagnostics after Next returns an error:
+// the kind is the scanner state, which is one of the token kinds or, while
+// inside a comment or a multi-line string header, one of the indicator
+// kinds from LCOMMENT_CLOSING onwards.
+func (sc *Scanner) LatestTag() (string, TokenKind, int) {
+	return sc.s.LatestTag()
+}
+
+// SetTabWidth makes a tab advance the column of tokens to the next multiple
+// of n, as an editor showing tabs n columns wide would. By default, and for
+// n below 2, a tab counts as one column like any other byte.
+func (sc *Scanner) SetTabWidth(n int) {
+	sc.s.tabwidth = n
+}
+
+// Next returns the next token, skipping whitespace. At the end of input it
+// returns io.EOF.
+func (sc *Scanner) Next() (Token, error) {
+	var err error
+	for {
+		for sc.tagsi < len(sc.tags) {
+			t := sc.tags[sc.tagsi]
+			sc.tagsi++
+			if t.state != WHITESPACE {
+				return Token{t.val, t.state, t.line, int(t.col)}, nil
+			}
+		}
+		sc.tags, err = sc.s.nexttags()
+		if err != nil {
+			return Token{}, err
+		}
+		sc.tagsi = 0
+	}
+}
+
+// Tokenize scans data and returns all of its tokens at once, skipping
+// whitespace. This is intended for small inputs, tests and tooling.
+func Tokenize(data []byte) ([]Token, error) {
+	sc := NewScanner(bytes.NewReader(data))
+	toks := make([]Token, 0, 64)
+	for {
+		tok, err := sc.Next()
+		if err == io.EOF {
+			return toks, nil
+		} else if err != nil {
+			return toks, err
+		}
+		toks = append(toks, tok)
+	}
+}
+
+// LatestTag returns the text of the token being scanned, the scanner state
+// and the current input line. After an error or the end of input it returns
+// what was being scanned at that point.
+func (s *scanner) LatestTag() (string, TokenKind, int) {
+	if s.curtag == nil {
+		return s.lasttag, s.state, s.line
+	}
+	return string(s.curtag), s.state, s.line
 }
 
 // From go-src:strconv.Unquote but modified so that a quote character can
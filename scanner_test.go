@@ -0,0 +1,449 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTokenize(t *testing.T) {
+	s := `# comment
+key value;
+"quoted" = 'single';
+section {
+	list [1, 2];
+}
+ml <<EOD
+one
+two
+EOD
+`
+	expect := []Token{
+		{[]byte("# comment"), HCOMMENT, 1, 1},
+		{[]byte("key"), TAG, 2, 1},
+		{[]byte("value"), TAG, 2, 5},
+		{[]byte(";"), SEMICOL, 2, 10},
+		{[]byte("quoted"), QUOTE, 3, 1},
+		{[]byte("="), EQUAL, 3, 10},
+		{[]byte("single"), VQUOTE, 3, 12},
+		{[]byte(";"), SEMICOL, 3, 20},
+		{[]byte("section"), TAG, 4, 1},
+		{[]byte("{"), BRACEOPEN, 4, 9},
+		{[]byte("list"), TAG, 5, 2},
+		{[]byte("["), BRACKETOPEN, 5, 7},
+		{[]byte("1"), TAG, 5, 8},
+		{[]byte(","), COMMA, 5, 9},
+		{[]byte("2"), TAG, 5, 11},
+		{[]byte("]"), BRACKETCLOSE, 5, 12},
+		{[]byte(";"), SEMICOL, 5, 13},
+		{[]byte("}"), BRACECLOSE, 6, 1},
+		{[]byte("ml"), TAG, 7, 1},
+		{[]byte("one\ntwo"), MLSTRING, 7, 4},
+	}
+
+	toks, err := Tokenize([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toks) != len(expect) {
+		t.Fatalf("expected %d tokens, got %d: %v", len(expect), len(toks), toks)
+	}
+	for i := range toks {
+		if string(toks[i].Value) != string(expect[i].Value) ||
+			toks[i].Kind != expect[i].Kind || toks[i].Line != expect[i].Line ||
+			toks[i].Col != expect[i].Col {
+			t.Errorf("token %d: got %q/%d/%d:%d, expected %q/%d/%d:%d", i,
+				toks[i].Value, toks[i].Kind, toks[i].Line, toks[i].Col,
+				expect[i].Value, expect[i].Kind, expect[i].Line, expect[i].Col)
+		}
+	}
+}
+
+func TestTokenKindString(t *testing.T) {
+	if TAG.String() != "TAG" || BRACKETCLOSE.String() != "BRACKETCLOSE" {
+		t.Error("unexpected TokenKind names", TAG, BRACKETCLOSE)
+	}
+	if TokenKind(-1).String() != "TokenKind(-1)" {
+		t.Error("unexpected name for invalid kind", TokenKind(-1))
+	}
+}
+
+// about 1MB of sections with a mix of token kinds
+func largeConfig() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1<<20; i++ {
+		fmt.Fprintf(&buf, "section%d {\n", i)
+		fmt.Fprintf(&buf, "\tname = \"section number %d\";\n", i)
+		fmt.Fprintf(&buf, "\tlist [ a, b, %d ];\n", i)
+		fmt.Fprintf(&buf, "\t# comment %d\n", i)
+		fmt.Fprintf(&buf, "\tvalue %d\n}\n", i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkScanner(b *testing.B) {
+	data := largeConfig()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s := newScanner(bytes.NewReader(data))
+		for {
+			_, err := s.nexttags()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecoderLarge(b *testing.B) {
+	data := largeConfig()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := NewDecoder(bytes.NewReader(data)).Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// many objects sharing the same keys, reporting the heap the result holds
+func BenchmarkDecoderInternKeys(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString("servers [\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "\t{ hostname h%d; port %d; enabled yes; "+
+			"weight 1; }\n", i, i)
+	}
+	buf.WriteString("]\n")
+	data := buf.Bytes()
+
+	for _, on := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%v", on), func(b *testing.B) {
+			var ms runtime.MemStats
+			var heap uint64
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				before := ms.HeapAlloc
+				d := NewDecoder(bytes.NewReader(data))
+				d.SetInternStrings(on)
+				v, err := d.Decode()
+				if err != nil {
+					b.Fatal(err)
+				}
+				d = nil
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				heap += ms.HeapAlloc - before
+				runtime.KeepAlive(v)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-B/op")
+		})
+	}
+}
+
+// longToken returns a config whose single value, in the given form, is n
+// bytes long, along with the decoded value
+func longToken(form string, n int) ([]byte, string) {
+	switch form {
+	case "heredoc":
+		line := strings.Repeat("heredoc ", 9) + "\n"
+		val := strings.Repeat(line, n/len(line))
+		return []byte("k <<EOD\n" + val + "EOD\n"), strings.TrimSuffix(val, "\n")
+	case "quoted":
+		esc := strings.Repeat(`quoted \"\\ `, n/11)
+		return []byte(`k "` + esc + "\";\n"), strings.Repeat(`quoted "\ `, n/11)
+	}
+	val := strings.Repeat("bareword", n/8)
+	return []byte("k " + val + ";\n"), val
+}
+
+// values of any length, read in any chunks, are scanned whole
+func TestLongTokens(t *testing.T) {
+	for _, form := range []string{"heredoc", "quoted", "bareword"} {
+		data, want := longToken(form, 1<<16)
+		for _, r := range []io.Reader{bytes.NewReader(data),
+			iotest.OneByteReader(bytes.NewReader(data))} {
+			v, err := NewDecoder(r).Decode()
+			if err != nil {
+				t.Errorf("%s: %v", form, err)
+				continue
+			}
+			if got, _ := v["k"].(string); got != want {
+				t.Errorf("%s: got %d bytes, want %d", form, len(got), len(want))
+			}
+		}
+	}
+}
+
+func benchmarkLongToken(b *testing.B, form string) {
+	data, _ := longToken(form, 5<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := NewDecoder(bytes.NewReader(data)).Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLongHeredoc(b *testing.B) {
+	benchmarkLongToken(b, "heredoc")
+}
+
+func BenchmarkLongQuoted(b *testing.B) {
+	benchmarkLongToken(b, "quoted")
+}
+
+func BenchmarkLongBareword(b *testing.B) {
+	benchmarkLongToken(b, "bareword")
+}
+
+// tags must not share the pooled tag buffer with later scans
+func TestScannerBufferReuse(t *testing.T) {
+	toks, err := Tokenize([]byte("first value;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Tokenize([]byte("XXXXX YYYYY;\n")); err != nil {
+		t.Fatal(err)
+	}
+	if string(toks[0].Value) != "first" || string(toks[1].Value) != "value" {
+		t.Errorf("token values overwritten: %q %q", toks[0].Value, toks[1].Value)
+	}
+}
+
+func TestScannerZeroCopy(t *testing.T) {
+	s := "key value;\nsection { a \"quoted\"; }\n"
+	expect, err := Tokenize([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewScanner(bytes.NewBufferString(s))
+	sc.SetZeroCopy(true)
+	for i := 0; ; i++ {
+		tok, err := sc.Next()
+		if err == io.EOF {
+			if i != len(expect) {
+				t.Errorf("expected %d tokens, got %d", len(expect), i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expect) || string(tok.Value) != string(expect[i].Value) ||
+			tok.Kind != expect[i].Kind {
+			t.Errorf("unexpected token %d: %q %v", i, tok.Value, tok.Kind)
+		}
+	}
+}
+
+func benchmarkNext(b *testing.B, zerocopy bool) {
+	data := largeConfig()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sc := NewScanner(bytes.NewReader(data))
+		sc.SetZeroCopy(zerocopy)
+		for {
+			_, err := sc.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkScannerNextCopy(b *testing.B) {
+	benchmarkNext(b, false)
+}
+
+func BenchmarkScannerNextZeroCopy(b *testing.B) {
+	benchmarkNext(b, true)
+}
+
+func TestBracketError(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"a {\n\tb [ 1,\n\t2 }\n", "unexpected '}' at line 3, column 4; expected ']' to close array opened at line 2"},
+		{"a [\n\t{ b 1 ]\n", "unexpected ']' at line 2, column 8; expected '}' to close object opened at line 2"},
+		{"a 1;\n]\n", "unexpected ']' at line 2, column 1; nothing to close"},
+		{"a {\nb 1;\n}\n}\n", "unexpected '}' at line 4, column 1; nothing to close"},
+	}
+	for _, test := range tests {
+		_, err := Tokenize([]byte(test.in))
+		if _, ok := err.(*BracketError); !ok {
+			t.Errorf("%q: expected BracketError, got %v", test.in, err)
+		} else if err.Error() != test.expect {
+			t.Errorf("%q: got %q, expected %q", test.in, err, test.expect)
+		}
+	}
+}
+
+func TestParentheses(t *testing.T) {
+	tests := []string{
+		"key (a b);\n",
+		"k3 (a;\nb);\n",
+		"k4 ( x { y 1 } )\n",
+		"k5 x )\n",
+	}
+	for _, in := range tests {
+		_, err := Tokenize([]byte(in))
+		if err == nil || !strings.Contains(err.Error(), "quote values") {
+			t.Errorf("%q: expected parenthesis error, got %v", in, err)
+		}
+	}
+
+	toks, err := Tokenize([]byte("k2 f(x);\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toks) < 2 || string(toks[1].Value) != "f(x)" {
+		t.Errorf("bareword with parentheses: got %v", toks)
+	}
+}
+
+func TestTokenColumns(t *testing.T) {
+	s := "a b c {\n\tkey\t\"v\\\"x\";\n\t\tk [1,\t2]\n}\n"
+	tests := []struct {
+		tabwidth int
+		cols     []int
+	}{
+		{0, []int{1, 3, 5, 7, 2, 6, 12, 3, 5, 6, 7, 9, 10, 1}},
+		{4, []int{1, 3, 5, 7, 5, 9, 15, 9, 11, 12, 13, 17, 18, 1}},
+	}
+	for _, test := range tests {
+		sc := NewScanner(bytes.NewBufferString(s))
+		sc.SetTabWidth(test.tabwidth)
+		var cols []int
+		for {
+			tok, err := sc.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			cols = append(cols, tok.Col)
+		}
+		if fmt.Sprint(cols) != fmt.Sprint(test.cols) {
+			t.Errorf("tab width %d: got columns %v, expected %v",
+				test.tabwidth, cols, test.cols)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	src := "\"name\" web;\n" +
+		"x<y 1;\n" +
+		"server {\n" +
+		"\tport 80; \n" +
+		"  \"host name\" a;\n" +
+		" \tb 2;\n" +
+		"\tlist [\"q\", r];\n" +
+		"\ttext <<EOD\n" +
+		"  keep  \n" +
+		"EOD\n" +
+		"\tquoted \"a  \n" +
+		"  b\";\n" +
+		"}\n" +
+		"# \"c\" 1;\n" +
+		"last 1"
+	issues, err := Lint([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		`line 1, column 1: key "name" need not be quoted`,
+		`line 2, column 1: key "x<y" should be quoted`,
+		`line 4, column 10: trailing whitespace`,
+		`line 5, column 1: indented with spaces, unlike line 4`,
+		`line 6, column 1: indentation mixes tabs and spaces`,
+		`line 15, column 7: missing newline at end of file`,
+	}
+	got := make([]string, len(issues))
+	for i := range issues {
+		got[i] = issues[i].String()
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("got\n%s\nexpected\n%s", strings.Join(got, "\n"),
+			strings.Join(expect, "\n"))
+	}
+
+	if issues, err := Lint([]byte("a {\n    b 1;\n}\n")); err != nil ||
+		len(issues) != 0 {
+		t.Errorf("clean source: got %v, %v", issues, err)
+	}
+	if _, err := Lint([]byte("a {\n")); err == nil {
+		t.Error("expected an error for unterminated input")
+	}
+}
+
+func TestDetectStyle(t *testing.T) {
+	tests := []struct {
+		in      string
+		indent  string
+		lineSep string
+	}{
+		{"a {\n\tb {\n\t\tc 1;\n\t}\n}\n", "\t", "\n"},
+		{"a {\n  b {\n    c 1;\n  }\n}\n", "  ", "\n"},
+		{"a {\n    b {\n        c 1;\n    }\n}\n", "    ", "\n"},
+		{"a {\r\n    b 1;\r\n}\r\n", "    ", "\r\n"},
+		{"a 1;\nb 2;\n", DefaultIndent, "\n"},
+		// lines of multi-line strings and comments do not count
+		{"a {\n\tb <<EOD\n  x\n  y\n  z\nEOD\n}\n/*\n   c\n   d\n*/\n", "\t", "\n"},
+		// most lines decide
+		{"a {\n  b 1;\n  c 2;\n\td 3;\n}\n", "  ", "\n"},
+	}
+	for _, test := range tests {
+		indent, sep := DetectStyle([]byte(test.in))
+		if indent != test.indent || sep != test.lineSep {
+			t.Errorf("%q: got %q, %q, expected %q, %q", test.in, indent, sep,
+				test.indent, test.lineSep)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Validation of decoded UCL against a schema, modelled on the subset of
+ * JSON Schema supported by libucl
+ */
+package ucl
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A ValidationError describes a value that does not match the schema.
+type ValidationError struct {
+	Path    string // dotted path of the value, empty for the root
+	Line    int    // line of the value's key, 0 if unknown
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (line %d): %s", e.Path, e.Line, e.Message)
+}
+
+// ValidationErrors is returned by Decode when the document does not match
+// the schema set with SetSchema.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// SetSchema sets a schema the decoded document is validated against. The
+// schema is typically itself decoded from UCL and supports these keys:
+//
+//	type                  object, array, string, number, integer, boolean or null
+//	enum                  list of allowed values
+//	properties            object of schemas for the keys of an object
+//	required              list of keys an object must have
+//	additionalProperties  false to reject keys not in properties
+//	items                 schema for the elements of an array
+//
+// Since decoded scalars are strings, number, integer and boolean accept
+// strings that parse as such.
+func (d *Decoder) SetSchema(schema map[string]interface{}) {
+	d.schema = schema
+}
+
+// SetRequiredKeys makes Decode check that each of paths, in the dotted form
+// taken by Get, is present in the document, as a lighter alternative to a
+// schema. Decode fails with ValidationErrors listing every path missing,
+// after any errors found by the schema. A key holding null is present.
+func (d *Decoder) SetRequiredKeys(paths []string) {
+	d.required = paths
+}
+
+// schemalist reads a schema value that is either a single string or a list
+func schemalist(v interface{}) []string {
+	switch vv := v.(type) {
+	case string:
+		return []string{vv}
+	case []interface{}:
+		l := make([]string, 0, len(vv))
+		for i := range vv {
+			l = append(l, fmt.Sprint(vv[i]))
+		}
+		return l
+	}
+	return nil
+}
+
+func schematype(typ string, v interface{}) (bool, error) {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok, nil
+	case "array":
+		_, ok := v.([]interface{})
+		return ok, nil
+	case "null":
+		return v == nil, nil
+	}
+
+	switch vv := v.(type) {
+	case string:
+		var err error
+		switch typ {
+		case "string":
+			return true, nil
+		case "number":
+			_, err = strconv.ParseFloat(vv, 64)
+		case "integer":
+			_, err = strconv.ParseInt(vv, 0, 64)
+		case "boolean":
+			switch strings.ToLower(vv) {
+			case "true", "false", "yes", "no", "on", "off":
+			default:
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown type %s in schema", typ)
+		}
+		return err == nil, nil
+	case Number:
+		switch typ {
+		case "number":
+			_, err := vv.Float64()
+			return err == nil, nil
+		case "integer":
+			_, err := vv.Int64()
+			return err == nil, nil
+		}
+		return false, nil
+	case Regex:
+		return typ == "string", nil
+	case bool:
+		return typ == "boolean", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return typ == "integer" || typ == "number", nil
+	case float32, float64:
+		return typ == "number", nil
+	}
+	return false, nil
+}
+
+// keys of a decoded object in document order if known, otherwise sorted
+func objkeys(m map[string]interface{}) []string {
+	if korder, ok := m[KeyOrder].([]string); ok {
+		return korder
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != KeyOrder {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *Decoder) validate(schema map[string]interface{}, v interface{},
+	path string, line int) (errs ValidationErrors) {
+
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, &ValidationError{path, line,
+			fmt.Sprintf(format, a...)})
+	}
+
+	if typ, ok := schema["type"].(string); ok {
+		ok, err := schematype(typ, v)
+		if err != nil {
+			fail("%v", err)
+			return errs
+		} else if !ok {
+			fail("expected %s", typ)
+			return errs
+		}
+	}
+
+	if enum, ok := schema["enum"]; ok {
+		found := false
+		sv := fmt.Sprint(v)
+		for _, allowed := range schemalist(enum) {
+			if sv == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("%s is not one of %s", sv,
+				strings.Join(schemalist(enum), ", "))
+		}
+	}
+
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for _, req := range schemalist(schema["required"]) {
+			if _, ok := vv[req]; !ok {
+				fail("missing required key %s", req)
+			}
+		}
+
+		props, _ := schema["properties"].(map[string]interface{})
+		lines := d.keylines(vv)
+		for _, k := range objkeys(vv) {
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				errs = append(errs, d.validate(ps, vv[k], join(k),
+					lines[k])...)
+			} else if fmt.Sprint(schema["additionalProperties"]) == "false" {
+				errs = append(errs, &ValidationError{join(k), lines[k],
+					"key not allowed"})
+			}
+		}
+
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i := range vv {
+				errs = append(errs, d.validate(items, vv[i],
+					join(strconv.Itoa(i)), line)...)
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"io"
+)
+
+// EventHandler receives the elements of a document from Decoder.Stream as
+// they are parsed. Returning an error from any method stops the parse.
+type EventHandler interface {
+	OnKey(key string) error
+	OnScalar(value interface{}) error // string, nil or a typed value
+	OnObjectStart() error
+	OnObjectEnd() error
+	OnArrayStart() error
+	OnArrayEnd() error
+}
+
+// Stream parses the input and dispatches events to h instead of building a
+// map, so memory use does not grow with the size of the document. The root
+// object is reported with OnObjectStart/OnObjectEnd like any other.
+//
+// Unlike Decode, repeated keys are reported as they appear rather than
+// being merged into arrays, and a multi-key statement such as "a b c;" is
+// reported as key "a" holding an object with key "b".
+func (d *Decoder) Stream(h EventHandler) error {
+	err := h.OnObjectStart()
+	if err == nil {
+		err = d.streamObject(h, false)
+	}
+	if err == nil || err == io.EOF {
+		err = h.OnObjectEnd()
+	}
+	return err
+}
+
+func (d *Decoder) streamObject(h EventHandler, nested bool) error {
+	for {
+		t, err := d.nexttag()
+		if err != nil {
+			return err
+		}
+
+		switch t.state {
+		case SEMICOL:
+			continue
+
+		case BRACEOPEN:
+			if nested {
+				return fmt.Errorf("unexpected '{' at line %d", t.line)
+			}
+			// document enclosed in braces
+			return d.streamObject(h, true)
+
+		case BRACECLOSE:
+			return nil
+
+		case TAG, QUOTE, VQUOTE, SLASH:
+			if err = h.OnKey(d.key(t.val)); err != nil {
+				return err
+			}
+			end, err := d.streamValue(h, nil)
+			if err != nil {
+				return err
+			}
+			if end == BRACECLOSE {
+				return nil
+			} else if end == BRACKETCLOSE {
+				return fmt.Errorf("unexpected ']' at line %d", d.scanner.line)
+			}
+
+		default:
+			return fmt.Errorf("unexpected '%s' at line %d", string(t.val),
+				t.line)
+		}
+	}
+}
+
+// streamValue reports the value of a key, starting at t if it is not nil.
+// If a closing brace or bracket ending the value's parent was consumed, its
+// kind is returned.
+func (d *Decoder) streamValue(h EventHandler, t *tag) (TokenKind, error) {
+	var err error
+	for t == nil || t.state == EQUAL || t.state == COLON {
+		if t, err = d.nexttag(); err != nil {
+			return WHITESPACE, err
+		}
+	}
+
+	switch t.state {
+	case TAG, QUOTE, VQUOTE, SLASH:
+		// either a value or the key of a nested object
+		nt, err := d.nexttag()
+		if err == io.EOF {
+			if err = h.OnScalar(d.scalar(t.val, t.state)); err != nil {
+				return WHITESPACE, err
+			}
+			return WHITESPACE, io.EOF
+		} else if err != nil {
+			return WHITESPACE, err
+		}
+
+		switch nt.state {
+		case SEMICOL, COMMA:
+			return WHITESPACE, h.OnScalar(d.scalar(t.val, t.state))
+		case BRACECLOSE, BRACKETCLOSE:
+			return nt.state, h.OnScalar(d.scalar(t.val, t.state))
+		}
+
+		if err = h.OnObjectStart(); err != nil {
+			return WHITESPACE, err
+		}
+		if err = h.OnKey(d.key(t.val)); err != nil {
+			return WHITESPACE, err
+		}
+		end, err := d.streamValue(h, nt)
+		if err != nil {
+			return end, err
+		}
+		return end, h.OnObjectEnd()
+
+	case MLSTRING:
+		return WHITESPACE, h.OnScalar(string(t.val))
+
+	case SEMICOL, COMMA:
+		// no value
+		return WHITESPACE, h.OnScalar(nil)
+
+	case BRACECLOSE, BRACKETCLOSE:
+		return t.state, h.OnScalar(nil)
+
+	case BRACEOPEN:
+		if err = h.OnObjectStart(); err != nil {
+			return WHITESPACE, err
+		}
+		if err = d.streamObject(h, true); err != nil {
+			return WHITESPACE, err
+		}
+		return WHITESPACE, h.OnObjectEnd()
+
+	case BRACKETOPEN:
+		return WHITESPACE, d.streamArray(h)
+	}
+
+	return WHITESPACE, fmt.Errorf("unexpected '%s' at line %d",
+		string(t.val), t.line)
+}
+
+func (d *Decoder) streamArray(h EventHandler) error {
+	if err := h.OnArrayStart(); err != nil {
+		return err
+	}
+
+	for {
+		t, err := d.nexttag()
+		if err != nil {
+			return err
+		}
+
+		switch t.state {
+		case BRACKETCLOSE:
+			return h.OnArrayEnd()
+
+		case COMMA:
+			continue
+
+		case SEMICOL, COLON, EQUAL:
+			return fmt.Errorf("Invalid tag %s line %d", string(t.val),
+				t.line)
+
+		default:
+			end, err := d.streamValue(h, t)
+			if err != nil {
+				return err
+			}
+			if end == BRACKETCLOSE {
+				return h.OnArrayEnd()
+			} else if end == BRACECLOSE {
+				return fmt.Errorf("unexpected '}' at line %d",
+					d.scanner.line)
+			}
+		}
+	}
+}
+
+// key returns the key in val as passed to the handler
+func (d *Decoder) key(val []byte) string {
+	if d.keyfunc != nil {
+		return d.keyfunc(d.internkey(val))
+	}
+	return d.internkey(val)
+}
+
+// nopHandler discards all events
+type nopHandler struct{}
+
+func (nopHandler) OnKey(string) error         { return nil }
+func (nopHandler) OnScalar(interface{}) error { return nil }
+func (nopHandler) OnObjectStart() error       { return nil }
+func (nopHandler) OnObjectEnd() error         { return nil }
+func (nopHandler) OnArrayStart() error        { return nil }
+func (nopHandler) OnArrayEnd() error          { return nil }
+
+// Validate checks the syntax of the UCL read from r without building the
+// decoded result, returning the first syntax error found.
+func Validate(r io.Reader) error {
+	return NewDecoder(r).Stream(nopHandler{})
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Inference of typed scalars from unquoted values
+ */
+package ucl
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Number is an unquoted numeric value kept as written, as decoded with
+// SetUseNumber. It may carry a size multiplier, as in "10k".
+type Number string
+
+// String returns the number as written.
+func (n Number) String() string {
+	return string(n)
+}
+
+// Int64 returns the number as an integer, applying any multiplier.
+func (n Number) Int64() (int64, error) {
+	i, ok := toint(string(n))
+	if !ok {
+		return 0, fmt.Errorf("cannot convert %q to int64", string(n))
+	}
+	return i, nil
+}
+
+// Float64 returns the number as a float, applying any multiplier.
+func (n Number) Float64() (float64, error) {
+	f, ok := tofloat(string(n))
+	if !ok {
+		return 0, fmt.Errorf("cannot convert %q to float64", string(n))
+	}
+	return f, nil
+}
+
+// MarshalJSON writes the number as written if that is valid JSON, and its
+// value otherwise, so that 0x1f or 10k become 31 and 10000.
+func (n Number) MarshalJSON() ([]byte, error) {
+	s := string(n)
+	if s != "" && (s[0] == '-' || s[0] >= '0' && s[0] <= '9') &&
+		json.Valid([]byte(s)) {
+		return []byte(s), nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return strconv.AppendInt(nil, i, 10), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
+
+// A Regex is the pattern of an unquoted regular expression written between
+// slashes, as in /^a\ b+$/, decoded with SetTypedValues. Within the slashes
+// only a backslash and the closing slash are special; whitespace, ';' and
+// ',' have to be escaped. In the pattern the escapes of '/', ' ', ';' and ','
+// are replaced by the byte they escape, others are kept for the regular
+// expression. The Encoder writes a Regex between slashes.
+type Regex string
+
+// String returns the pattern.
+func (r Regex) String() string {
+	return string(r)
+}
+
+// text returns r between slashes, escaping slashes, whitespace and
+// terminators so that the result reads back as a single value
+func (r Regex) text() string {
+	var b strings.Builder
+	b.WriteByte('/')
+	for i := 0; i < len(r); i++ {
+		switch c := r[i]; c {
+		case '\\':
+			b.WriteByte(c)
+			if i+1 < len(r) {
+				i++
+				b.WriteByte(r[i])
+			}
+		case '/', ' ', ';', ',':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('/')
+	return b.String()
+}
+
+// toregex returns the Regex of s if it is a pattern between slashes, with
+// no unescaped slash in between
+func toregex(s string) (Regex, bool) {
+	if len(s) < 2 || s[0] != '/' || s[len(s)-1] != '/' {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s)-1 {
+				i++
+				if strings.IndexByte("/ ;,", s[i]) < 0 {
+					b.WriteByte(c)
+				}
+				c = s[i]
+			}
+			b.WriteByte(c)
+		case '/':
+			return "", false
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return Regex(b.String()), true
+}
+
+// Multiplier suffixes as understood by libucl, longest first so that "kb"
+// is tried before "k" and "min" before "m"
+var intMultipliers = []struct {
+	suffix string
+	mult   int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+}
+
+// time suffixes, converting to seconds
+var timeMultipliers = []struct {
+	suffix string
+	mult   float64
+}{
+	{"min", 60}, {"ms", 0.001},
+	{"s", 1}, {"h", 60 * 60}, {"d", 24 * 60 * 60}, {"w", 7 * 24 * 60 * 60},
+	{"y", 365 * 24 * 60 * 60},
+}
+
+// looksnumeric reports whether s starts like a number, which keeps words
+// such as "inf" or "nan" from being taken as floats
+func looksnumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	if s[0] == '-' || s[0] == '+' {
+		s = s[1:]
+	}
+	return s != "" && (s[0] >= '0' && s[0] <= '9' || s[0] == '.')
+}
+
+// parseint parses a decimal or 0x hexadecimal integer
+func parseint(s string) (int64, error) {
+	neg := strings.HasPrefix(s, "-")
+	u := strings.TrimLeft(s, "+-")
+	if strings.HasPrefix(u, "0x") || strings.HasPrefix(u, "0X") {
+		i, err := strconv.ParseInt(u[2:], 16, 64)
+		if neg {
+			i = -i
+		}
+		return i, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// parsenumber parses a number with an optional size multiplier, returning
+// int64 or float64
+func parsenumber(s string) (interface{}, bool) {
+	if !looksnumeric(s) {
+		return nil, false
+	}
+	if i, err := parseint(s); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+
+	ls := strings.ToLower(s)
+	for _, m := range intMultipliers {
+		if !strings.HasSuffix(ls, m.suffix) {
+			continue
+		}
+		n := s[:len(s)-len(m.suffix)]
+		if i, err := parseint(n); err == nil {
+			return i * m.mult, true
+		}
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return f * float64(m.mult), true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// parseseconds parses a time value with a suffix such as "30s" or "5min"
+// into seconds
+func parseseconds(s string) (float64, bool) {
+	if !looksnumeric(s) {
+		return 0, false
+	}
+	ls := strings.ToLower(s)
+	for _, m := range timeMultipliers {
+		if !strings.HasSuffix(ls, m.suffix) {
+			continue
+		}
+		f, err := strconv.ParseFloat(s[:len(s)-len(m.suffix)], 64)
+		if err != nil {
+			return 0, false
+		}
+		return f * m.mult, true
+	}
+	return 0, false
+}
+
+// parsebool recognizes the boolean keywords of UCL
+func parsebool(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, true
+	case "false", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// typedvalue infers the type of an unquoted scalar: null and nil, booleans,
+// integers (int64), floats and numbers with size multipliers, and times in
+// seconds (float64). Anything else is returned as a string.
+func typedvalue(s string) interface{} {
+	if s == "null" || s == "nil" {
+		return nil
+	}
+	if b, ok := parsebool(s); ok {
+		return b
+	}
+	if n, ok := parsenumber(s); ok {
+		return n
+	}
+	if f, ok := parseseconds(s); ok {
+		return f
+	}
+	return s
+}
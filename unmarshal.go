@@ -0,0 +1,730 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Storing of decoded UCL into Go values
+ */
+package ucl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+	bigRatType   = reflect.TypeOf(big.Rat{})
+)
+
+// An UnmarshalError describes a decoded value that cannot be stored in the
+// Go value it maps to.
+type UnmarshalError struct {
+	Path    string // dotted path of the value, empty for the root
+	Line    int    // line of the value's key, 0 if unknown
+	Message string
+}
+
+func (e *UnmarshalError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (line %d): %s", e.Path, e.Line, e.Message)
+}
+
+// Unmarshal decodes the UCL document in data and stores it in the value
+// pointed to by v; see Decoder.Unmarshal.
+func Unmarshal(data []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Unmarshal(v)
+}
+
+// DecodeStrict decodes the UCL read from r and stores it in the value
+// pointed to by v like Unmarshal, but fails on anything suspect rather than
+// passing it over. It is meant for checking configurations written by
+// trusted authors, e.g. in CI. Besides syntax errors, which here include
+// input left after a top-level object enclosed in braces, it fails on:
+//
+//	a key that matches no struct field    as with DisallowUnknownFields
+//	a key repeated within an object       as with DuplicateError
+//
+// Errors are *DuplicateKeyError and *UnmarshalError values carrying the
+// line of the offending key.
+func DecodeStrict(r io.Reader, v interface{}) error {
+	d := NewDecoder(r)
+	d.DisallowUnknownFields()
+	d.SetDuplicateKeyMode(DuplicateError)
+	d.strict = true
+	return d.Unmarshal(v)
+}
+
+// Unmarshal decodes the input and stores it in the value pointed to by v.
+//
+// Objects are stored in structs, matching keys against the name in the
+// field's json tag or else the field name, and in maps with string keys.
+// Arrays are stored in slices and arrays; a single value stored in a slice
+// becomes its only element. Scalars are converted to the kind of the
+// destination, so "10k" can be stored in an int and "yes" in a bool.
+// Pointers are allocated as needed, also for the elements of a []*T. An
+// unquoted null or nil stores the zero value, so a nil pointer; quoted, "null"
+// and "nil" are strings. Values stored in interface{} are left as decoded. Keys
+// without a matching field are ignored, or stored in the struct's map field
+// with the "remain" tag option, as in `json:",remain"`, if it has one. A
+// []string field with the "keyorder" tag option is set to the keys of the
+// object in document order, which the Encoder then writes the fields in.
+//
+// A time.Duration takes a time such as "30s", "5min" or "1h30m"; plain
+// numbers are seconds. An integer field with the "bytes" tag option, as in
+// `json:"limit,bytes"`, takes a size in which "k", "m" and "g" are powers of
+// 1024 like "kb", "mb" and "gb", and "b" stands for bytes. A big.Int,
+// big.Float or big.Rat takes a number of any size. A time.Time takes a time
+// in one of the layouts set by SetTimeLayouts. An integer type registered
+// with RegisterEnum takes the names of its values.
+func (d *Decoder) Unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	d.unmarshaling = true
+	ucl, err := d.Decode()
+	if err != nil {
+		return err
+	}
+	return d.store(rv.Elem(), ucl, "", 0)
+}
+
+// DecodeSection decodes the input like Unmarshal but only stores the value
+// at the dotted path, such as "servers.web" or "listen.0" for the first
+// element of an array, in the value pointed to by v. Paths are written as
+// for Get. It fails if the path does not exist.
+func (d *Decoder) DecodeSection(path string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("DecodeSection needs a non-nil pointer, got %T", v)
+	}
+
+	d.unmarshaling = true
+	ucl, err := d.Decode()
+	if err != nil {
+		return err
+	}
+	sub, line, err := d.section(ucl, path)
+	if err != nil {
+		return err
+	}
+	return d.store(rv.Elem(), sub, path, line)
+}
+
+// section returns the value at the dotted path below v and the line of its
+// key
+func (d *Decoder) section(v interface{}, path string) (interface{}, int,
+	error) {
+
+	if path == "" {
+		return v, 0, nil
+	}
+	line := 0
+	parts := strings.Split(path, ".")
+	for i, k := range parts {
+		missing := &UnmarshalError{strings.Join(parts[:i+1], "."), line,
+			"not found"}
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[k]; !ok || k == KeyOrder {
+				return nil, 0, missing
+			}
+			line = d.keylines(vv)[k]
+		case []interface{}:
+			n, ok := arrayindex(k, len(vv))
+			if !ok {
+				return nil, 0, missing
+			}
+			v = vv[n]
+		default:
+			return nil, 0, missing
+		}
+	}
+	return v, line, nil
+}
+
+// store converts the decoded value v to the type of rv and sets rv to it
+func (d *Decoder) store(rv reflect.Value, v interface{}, path string,
+	line int) error {
+
+	fail := func(format string, a ...interface{}) error {
+		return &UnmarshalError{path, line, fmt.Sprintf(format, a...)}
+	}
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	if v == nil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	if f, ok := d.decoders[rv.Type()]; ok {
+		switch v.(type) {
+		case map[string]interface{}:
+			return fail("cannot store object in %s", rv.Type())
+		case []interface{}:
+			return fail("cannot store array in %s", rv.Type())
+		}
+		res, err := f(fmt.Sprint(v))
+		if err != nil {
+			return fail("%v", err)
+		}
+		rres := reflect.ValueOf(res)
+		if !rres.IsValid() {
+			rres = reflect.Zero(rv.Type())
+		} else if !rres.Type().AssignableTo(rv.Type()) {
+			return fail("decoder for %s returned %T", rv.Type(), res)
+		}
+		rv.Set(rres)
+		return nil
+	}
+
+	if n, ok := d.enumvalue(rv.Type(), v); ok {
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			if !rv.OverflowInt(n) {
+				rv.SetInt(n)
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+			reflect.Uint64, reflect.Uintptr:
+			if n >= 0 && !rv.OverflowUint(uint64(n)) {
+				rv.SetUint(uint64(n))
+				return nil
+			}
+		}
+		return fail("cannot store %q in %s", v, rv.Type())
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.store(rv.Elem(), v, path, line)
+
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return fail("cannot store in %s", rv.Type())
+		}
+		rv.Set(reflect.ValueOf(v))
+		return nil
+
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			t, ok := d.totime(v)
+			if !ok {
+				return fail("cannot store %q in %s", fmt.Sprint(v), rv.Type())
+			}
+			rv.Set(reflect.ValueOf(t))
+			return nil
+		}
+		if ok, isbig := setbignum(rv, v); isbig {
+			if !ok {
+				return fail("cannot store %q in %s", fmt.Sprint(v), rv.Type())
+			}
+			return nil
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("expected object for %s", rv.Type())
+		}
+		fields, remain, keyorder := structfields(rv.Type())
+		lines := d.keylines(m)
+		var rest reflect.Value
+		if remain != nil {
+			rest = fieldbyindex(rv, remain)
+			if rest.Kind() != reflect.Map ||
+				rest.Type().Key().Kind() != reflect.String {
+				return fail("remain field must be a map with string keys, "+
+					"not %s", rest.Type())
+			}
+		}
+		if keyorder != nil {
+			order := fieldbyindex(rv, keyorder)
+			if order.Type() != reflect.TypeOf([]string(nil)) {
+				return fail("keyorder field must be []string, not %s",
+					order.Type())
+			}
+			order.Set(reflect.ValueOf(append([]string(nil), objkeys(m)...)))
+		}
+		for _, k := range objkeys(m) {
+			f, ok := fields[k]
+			if !ok && d.foldfields {
+				var names []string
+				for name := range fields {
+					if strings.EqualFold(name, k) {
+						names = append(names, name)
+					}
+				}
+				if len(names) > 1 {
+					sort.Strings(names)
+					return &UnmarshalError{join(k), lines[k],
+						"matches fields " + strings.Join(names, ", ")}
+				}
+				if len(names) == 1 {
+					f, ok = fields[names[0]], true
+				}
+			}
+			if !ok && remain != nil {
+				if rest.IsNil() {
+					rest.Set(reflect.MakeMap(rest.Type()))
+				}
+				ev := reflect.New(rest.Type().Elem()).Elem()
+				if err := d.store(ev, m[k], join(k), lines[k]); err != nil {
+					return err
+				}
+				rest.SetMapIndex(reflect.ValueOf(k).Convert(rest.Type().Key()),
+					ev)
+				continue
+			}
+			if !ok {
+				if d.nounknown {
+					return &UnmarshalError{join(k), lines[k], "unknown field"}
+				}
+				continue
+			}
+			fv := fieldbyindex(rv, f.index)
+			var err error
+			if f.bytes {
+				err = d.storesize(fv, m[k], join(k), lines[k])
+			} else {
+				err = d.store(fv, m[k], join(k), lines[k])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("expected object for %s", rv.Type())
+		}
+		if rv.Type().Key().Kind() != reflect.String {
+			return fail("cannot store object in %s", rv.Type())
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		lines := d.keylines(m)
+		for _, k := range objkeys(m) {
+			ev := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.store(ev, m[k], join(k), lines[k]); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()), ev)
+		}
+		return nil
+
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		sv := reflect.MakeSlice(rv.Type(), len(list), len(list))
+		for i := range list {
+			if err := d.store(sv.Index(i), list[i], join(strconv.Itoa(i)),
+				line); err != nil {
+				return err
+			}
+		}
+		rv.Set(sv)
+		return nil
+
+	case reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok {
+			return fail("expected array for %s", rv.Type())
+		}
+		if len(list) > rv.Len() {
+			return fail("%d values do not fit in %s", len(list), rv.Type())
+		}
+		for i := range list {
+			if err := d.store(rv.Index(i), list[i], join(strconv.Itoa(i)),
+				line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch v.(type) {
+	case map[string]interface{}:
+		return fail("cannot store object in %s", rv.Type())
+	case []interface{}:
+		return fail("cannot store array in %s", rv.Type())
+	}
+	if n, ok := v.(Number); ok {
+		v = string(n)
+	}
+	s := fmt.Sprint(v)
+
+	if rv.Type() == durationType {
+		dur, ok := toduration(v)
+		if !ok {
+			return fail("cannot store %q in %s", s, rv.Type())
+		}
+		rv.SetInt(int64(dur))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			if b, ok = parsebool(s); !ok {
+				return fail("cannot store %q in %s", s, rv.Type())
+			}
+		}
+		rv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		n, ok := toint(v)
+		if !ok || rv.OverflowInt(n) {
+			return fail("cannot store %q in %s", s, rv.Type())
+		}
+		rv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		n, ok := toint(v)
+		if !ok || n < 0 || rv.OverflowUint(uint64(n)) {
+			return fail("cannot store %q in %s", s, rv.Type())
+		}
+		rv.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := tofloat(v)
+		if !ok || rv.OverflowFloat(f) {
+			return fail("cannot store %q in %s", s, rv.Type())
+		}
+		rv.SetFloat(f)
+
+	default:
+		return fail("cannot store %q in %s", s, rv.Type())
+	}
+	return nil
+}
+
+// enumvalue looks up v as the name of a value of the enum type t
+func (d *Decoder) enumvalue(t reflect.Type, v interface{}) (int64, bool) {
+	s, ok := v.(string)
+	if !ok || d.enums[t] == nil {
+		return 0, false
+	}
+	n, ok := d.enums[t][s]
+	return n, ok
+}
+
+// storesize sets the integer rv to the size v, taking the multipliers of
+// the "bytes" tag option
+func (d *Decoder) storesize(rv reflect.Value, v interface{}, path string,
+	line int) error {
+
+	if rv.Kind() == reflect.Ptr && v != nil {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.storesize(rv.Elem(), v, path, line)
+	}
+	if n, ok := v.(Number); ok {
+		v = string(n)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return d.store(rv, v, path, line)
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		return d.store(rv, v, path, line)
+	}
+
+	n, ok := tosize(s)
+	if !ok {
+		return &UnmarshalError{path, line,
+			fmt.Sprintf("cannot store %q in %s", s, rv.Type())}
+	}
+	return d.store(rv, n, path, line)
+}
+
+// tosize parses a size in bytes, where the suffixes "k", "m" and "g" are
+// binary multipliers like "kb", "mb" and "gb"
+func tosize(s string) (int64, bool) {
+	ls := strings.ToLower(s)
+	if !looksnumeric(ls) {
+		return 0, false
+	}
+	ls = strings.TrimSuffix(ls, "b")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(ls, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(ls, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(ls, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		ls = ls[:len(ls)-1]
+	}
+	if i, err := parseint(ls); err == nil {
+		return i * mult, true
+	}
+	if f, err := strconv.ParseFloat(ls, 64); err == nil &&
+		f*float64(mult) == float64(int64(f*float64(mult))) {
+		return int64(f * float64(mult)), true
+	}
+	return 0, false
+}
+
+// toduration converts a decoded scalar to a duration, taking UCL time
+// suffixes, Go duration strings and numbers of seconds
+func toduration(v interface{}) (time.Duration, bool) {
+	switch n := v.(type) {
+	case int64:
+		return time.Duration(n) * time.Second, true
+	case float64:
+		return time.Duration(n * float64(time.Second)), true
+	case string:
+		if f, ok := parseseconds(n); ok {
+			return time.Duration(f * float64(time.Second)), true
+		}
+		if dur, err := time.ParseDuration(n); err == nil {
+			return dur, true
+		}
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return time.Duration(f * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+// totime parses the scalar v as a time in one of the layouts set by
+// SetTimeLayouts
+func (d *Decoder) totime(v interface{}) (time.Time, bool) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return time.Time{}, false
+	}
+	s := fmt.Sprint(v)
+	layouts := d.timelayouts
+	if layouts == nil {
+		layouts = []string{time.RFC3339Nano}
+	}
+	for _, layout := range layouts {
+		if layout == UnixTime {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return time.Unix(n, 0), true
+			}
+		} else if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// setbignum sets rv to the scalar v if rv is a big.Int, big.Float or
+// big.Rat, reporting whether v could be parsed and whether rv is one
+func setbignum(rv reflect.Value, v interface{}) (ok bool, isbig bool) {
+	if !rv.CanAddr() {
+		return false, false
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false, rv.Type() == bigIntType || rv.Type() == bigFloatType ||
+			rv.Type() == bigRatType
+	}
+	s := fmt.Sprint(v)
+	switch n := rv.Addr().Interface().(type) {
+	case *big.Int:
+		_, ok = n.SetString(s, 0)
+	case *big.Float:
+		if n.Prec() == 0 {
+			// enough bits for every digit given
+			n.SetPrec(uint(64 + 4*len(s)))
+		}
+		_, ok = n.SetString(s)
+	case *big.Rat:
+		_, ok = n.SetString(s)
+	default:
+		return false, false
+	}
+	return ok, true
+}
+
+// toint converts a decoded scalar to an integer, accepting numbers with
+// multipliers and floats without a fractional part
+func toint(v interface{}) (int64, bool) {
+	if s, ok := v.(string); ok {
+		var ok bool
+		if v, ok = parsenumber(s); !ok {
+			return 0, false
+		}
+	}
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// tofloat converts a decoded scalar to a float
+func tofloat(v interface{}) (float64, bool) {
+	if s, ok := v.(string); ok {
+		var ok bool
+		if v, ok = parsenumber(s); !ok {
+			return 0, false
+		}
+	}
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// A structfield locates a field by its index sequence
+type structfield struct {
+	index []int
+	bytes bool // the field takes a size, from the "bytes" tag option
+}
+
+// structfields maps the keys of struct type t to their fields, including
+// the fields of embedded structs, and returns the indexes of the fields with
+// the "remain" and "keyorder" tag options, if any
+func structfields(t reflect.Type) (map[string]structfield, []int, []int) {
+	fields := make(map[string]structfield)
+	var remain, keyorder []int
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			idx := append(append([]int(nil), index...), i)
+
+			name := sf.Name
+			bytes, rest, order := false, false, false
+			if tag := sf.Tag.Get(DefaultTag); tag == "-" {
+				continue
+			} else if tag != "" {
+				opts := strings.Split(tag, ",")
+				if opts[0] != "" {
+					name = opts[0]
+				}
+				for _, o := range opts[1:] {
+					bytes = bytes || o == "bytes"
+					rest = rest || o == "remain"
+					order = order || o == "keyorder"
+				}
+			} else if sf.Anonymous {
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					if sf.PkgPath != "" {
+						// a nil pointer to an unexported struct cannot
+						// be allocated, so skip its fields like
+						// encoding/json
+						continue
+					}
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, idx)
+					continue
+				}
+			}
+			if sf.PkgPath != "" {
+				// unexported
+				continue
+			}
+			if rest {
+				if remain == nil || len(idx) < len(remain) {
+					remain = idx
+				}
+				continue
+			}
+			if order {
+				if keyorder == nil || len(idx) < len(keyorder) {
+					keyorder = idx
+				}
+				continue
+			}
+			if f, ok := fields[name]; !ok || len(idx) < len(f.index) {
+				fields[name] = structfield{idx, bytes}
+			}
+		}
+	}
+	walk(t, nil)
+	return fields, remain, keyorder
+}
+
+// fieldbyindex returns the field of rv at index, allocating nil embedded
+// struct pointers on the way
+func fieldbyindex(rv reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv
+}
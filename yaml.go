@@ -0,0 +1,342 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Emits an interface as YAML, sharing the Encoder's reflection walk
+ */
+package ucl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// YAML output is always indented by two spaces per level
+const yamlIndent = "  "
+
+// yamlEmpty reports whether a compound value has nothing to emit and must be
+// written in flow style ({} or [])
+func yamlEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return v.Len() == 0
+	case reflect.Struct:
+		return v.NumField() == 0
+	}
+	return false
+}
+
+func yamlFlowEmpty(v reflect.Value) string {
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		return "[]"
+	}
+	return "{}"
+}
+
+// quote strings that YAML would otherwise read as another type or syntax
+func yamlStr(s string) string {
+	if s == "" || s[0] == ' ' || s[len(s)-1] == ' ' ||
+		strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") ||
+		strings.HasSuffix(s, ":") {
+		return strconv.Quote(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~",
+		"y", "n", ".inf", "-.inf", ".nan":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (e *Encoder) yamlEncode(v reflect.Value, indent int) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("<map> %v %s", v, "does not use string key")
+		}
+		return e.yamlMap(v, indent)
+	case reflect.Struct:
+		return e.yamlStruct(v, indent)
+	case reflect.Slice, reflect.Array:
+		return e.yamlSlice(v, indent)
+	default:
+		return e.yamlScalar(v, indent)
+	}
+}
+
+// keys of a map in KeyOrder if present, otherwise sorted
+func yamlKeys(v reflect.Value) []string {
+	mv := v.MapIndex(reflect.ValueOf(KeyOrder).Convert(v.Type().Key()))
+	if mv.IsValid() {
+		if korder, ok := mv.Interface().([]string); ok {
+			return korder
+		}
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		if k.String() != KeyOrder {
+			keys = append(keys, k.String())
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *Encoder) yamlMap(v reflect.Value, indent int) (err error) {
+	for _, k := range yamlKeys(v) {
+		cv := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		if !cv.IsValid() {
+			continue
+		}
+		if err = e.yamlEntry(k, cv, indent); err != nil {
+			break
+		}
+	}
+	return err
+}
+
+func (e *Encoder) yamlStruct(v reflect.Value, indent int) (err error) {
+	order := e.fieldorder(v)
+	for n := 0; n < len(order) && err == nil; n++ {
+		i := order[n]
+		sf := v.Type().Field(i)
+		cv := deref(v.Field(i))
+
+		if sf.Anonymous {
+			if cv.Kind() == reflect.Struct {
+				err = e.yamlStruct(cv, indent)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		key := sf.Name
+		tag := sf.Tag.Get(e.tag)
+		if tag == "-" {
+			continue
+		}
+		if name := strings.SplitN(tag, ",", 2)[0]; name != "" {
+			key = name
+		}
+		err = e.yamlEntry(key, cv, indent)
+	}
+	return err
+}
+
+func (e *Encoder) yamlEntry(key string, cv reflect.Value, indent int) error {
+	cv, err := lazy(deref(cv))
+	if err != nil {
+		return err
+	}
+	if e.omitted(cv) {
+		return nil
+	}
+	indents := strings.Repeat(yamlIndent, indent)
+
+	fmt.Fprintf(e.w, "%s%s:", indents, yamlStr(key))
+	if _, ok := bignum(cv); ok || istime(cv) {
+		e.w.WriteString(" ")
+		return e.yamlScalar(cv, indent+1)
+	}
+	switch cv.Kind() {
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		if yamlEmpty(cv) || cv.Kind() == reflect.Map && e.emptyobject(cv) {
+			fmt.Fprintf(e.w, " %s\n", yamlFlowEmpty(cv))
+			return nil
+		}
+		e.w.WriteString("\n")
+		return e.yamlEncode(cv, indent+1)
+	default:
+		e.w.WriteString(" ")
+		return e.yamlScalar(cv, indent+1)
+	}
+}
+
+// yamlArray writes the elements produced for EncodeArray as a sequence,
+// holding back the newline ending each until it is known not to be the
+// last, for SetTrailingNewline
+func (e *Encoder) yamlArray(fn func(yield func(interface{}) error) error) error {
+	held := false
+	err := fn(func(item interface{}) error {
+		var buf bytes.Buffer
+		w := e.w
+		e.w = bufio.NewWriter(&buf)
+		err := e.yamlSlice(reflect.ValueOf([]interface{}{item}), 0)
+		e.w.Flush()
+		e.w = w
+
+		if held {
+			e.w.WriteString("\n")
+		}
+		out := buf.Bytes()
+		if held = bytes.HasSuffix(out, []byte("\n")); held {
+			out = out[:len(out)-1]
+		}
+		e.w.Write(out)
+		return err
+	})
+	if held && (!e.fixnl || e.trailingnl) {
+		e.w.WriteString("\n")
+	}
+	if err != nil {
+		e.Flush()
+		return err
+	}
+	return e.Flush()
+}
+
+func (e *Encoder) yamlSlice(v reflect.Value, indent int) (err error) {
+	indents := strings.Repeat(yamlIndent, indent)
+
+	for i := 0; i < v.Len() && err == nil; i++ {
+		var cv reflect.Value
+		if cv, err = lazy(deref(v.Index(i))); err != nil {
+			break
+		}
+
+		kind := cv.Kind()
+		if _, ok := bignum(cv); ok || istime(cv) {
+			kind = reflect.String
+		}
+		switch kind {
+		case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+			if yamlEmpty(cv) {
+				fmt.Fprintf(e.w, "%s- %s\n", indents, yamlFlowEmpty(cv))
+				break
+			}
+
+			// Encode the child one level deeper, then replace the
+			// indentation of its first line with the "- " marker
+			var buf bytes.Buffer
+			child := *e
+			child.w = bufio.NewWriter(&buf)
+			if err = child.yamlEncode(cv, indent+1); err != nil {
+				break
+			}
+			child.Flush()
+			out := buf.String()
+			skip := len(indents) + len(yamlIndent)
+			if len(out) <= skip {
+				fmt.Fprintf(e.w, "%s- %s\n", indents, yamlFlowEmpty(cv))
+				break
+			}
+			fmt.Fprintf(e.w, "%s- %s", indents, out[skip:])
+
+		default:
+			fmt.Fprintf(e.w, "%s- ", indents)
+			err = e.yamlScalar(cv, indent+1)
+		}
+	}
+	return err
+}
+
+// yamlScalar writes a scalar followed by a newline; indent is the level of
+// any block scalar content
+func (e *Encoder) yamlScalar(v reflect.Value, indent int) error {
+	if name, ok := e.enumname(v); ok {
+		fmt.Fprintf(e.w, "%s\n", yamlStr(name))
+		return nil
+	}
+	if istime(v) {
+		s, bare := e.timetext(v)
+		if !bare {
+			s = yamlStr(s)
+		}
+		fmt.Fprintf(e.w, "%s\n", s)
+		return nil
+	}
+	if s, ok := bignum(v); ok {
+		if !looksnumeric(s) || strings.IndexByte(s, '/') >= 0 {
+			s = yamlStr(s)
+		}
+		fmt.Fprintf(e.w, "%s\n", s)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		e.w.WriteString("null\n")
+	case reflect.Bool:
+		fmt.Fprintf(e.w, "%t\n", v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Float32, reflect.Float64:
+		fmt.Fprintf(e.w, "%v\n", v.Interface())
+	case reflect.String:
+		s := v.String()
+		if !strings.Contains(s, "\n") || strings.HasPrefix(s, " ") {
+			fmt.Fprintf(e.w, "%s\n", yamlStr(s))
+			break
+		}
+
+		// block scalar; keep (+), clip ( ) or strip (-) trailing newlines
+		chomp := "-"
+		if strings.HasSuffix(s, "\n\n") {
+			chomp = "+"
+		} else if strings.HasSuffix(s, "\n") {
+			chomp = ""
+		}
+		fmt.Fprintf(e.w, "|%s\n", chomp)
+
+		indents := strings.Repeat(yamlIndent, indent)
+		if chomp != "+" {
+			s = strings.TrimSuffix(s, "\n")
+		}
+		lines := strings.Split(s, "\n")
+		if chomp == "+" {
+			lines = lines[:len(lines)-1]
+		}
+		for _, l := range lines {
+			if l == "" {
+				e.w.WriteString("\n")
+			} else {
+				fmt.Fprintf(e.w, "%s%s\n", indents, l)
+			}
+		}
+	default:
+		fmt.Fprintf(e.w, "%s\n", yamlStr(fmt.Sprint(v.Interface())))
+	}
+	return nil
+}